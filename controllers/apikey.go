@@ -0,0 +1,88 @@
+package controllers
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+	"gorm.io/gorm"
+)
+
+type CreateApiKeyRequest struct {
+	Name      string   `json:"name" form:"name" binding:"required"`
+	Scopes    []string `json:"scopes" form:"scopes" binding:"required"` // 权限范围：upload、read、admin
+	ExpiresIn int64    `json:"expiresIn" form:"expiresIn"`              // 有效期，单位秒，0表示永不过期
+}
+
+type CreateApiKeyResponse struct {
+	*models.ApiKey
+	Key string `json:"key"` // API Key明文，只在创建时返回一次
+}
+
+// 当前用户的API Key列表
+func HandleApiKeyList(c *gin.Context) {
+	keys, err := models.ListApiKeys(currentUser(c).ID)
+	if err != nil {
+		helpers.AppLogger.Errorf("查询API Key失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询API Key失败", Data: nil})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse[[]*models.ApiKey]{Code: Success, Message: "", Data: keys})
+}
+
+// 创建API Key，在Authorization头中使用：Bearer bk_xxx
+func HandleApiKeyCreate(c *gin.Context) {
+	var req CreateApiKeyRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	// API Key的权限不能超过账号角色的权限
+	for _, scope := range req.Scopes {
+		if slices.Contains(models.Scopes, scope) && !user.HasScope(scope) {
+			c.JSON(http.StatusForbidden, APIResponse[any]{Code: Forbidden, Message: "账号没有 " + scope + " 权限，无法创建该权限的API Key", Data: nil})
+			return
+		}
+	}
+	var expiresAt int64
+	if req.ExpiresIn > 0 {
+		expiresAt = time.Now().Unix() + req.ExpiresIn
+	}
+	apiKey, key, err := models.CreateApiKey(user.ID, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		helpers.AppLogger.Errorf("创建API Key失败: %v", err)
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "创建API Key失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AuthLogger.Infof("用户 %s 创建了API Key %s (%s), 权限: %s", user.Username, apiKey.Prefix, apiKey.Name, apiKey.Scopes)
+	audit(c, models.AuditApiKeyCreate, apiKey.Prefix, "scopes="+apiKey.Scopes)
+	c.JSON(http.StatusOK, APIResponse[CreateApiKeyResponse]{Code: Success, Message: "", Data: CreateApiKeyResponse{ApiKey: apiKey, Key: key}})
+}
+
+// 撤销API Key，撤销后立即失效
+func HandleApiKeyRevoke(c *gin.Context) {
+	var req UserIdRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	if err := models.RevokeApiKey(user.ID, req.ID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "API Key不存在", Data: nil})
+			return
+		}
+		helpers.AppLogger.Errorf("撤销API Key失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "撤销API Key失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AuthLogger.Infof("用户 %s 撤销了API Key %d", user.Username, req.ID)
+	audit(c, models.AuditApiKeyRevoke, strconv.FormatUint(uint64(req.ID), 10), "")
+	c.JSON(http.StatusOK, APIResponse[any]{Code: Success, Message: "撤销成功", Data: nil})
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+)
+
+// 审计事件的操作者：用户、IP和客户端系统
+type auditActor struct {
+	UserId   uint
+	Username string
+	IP       string
+	ClientOS helpers.ClientOS
+}
+
+// 根据登录用户和设备会话生成操作者，客户端系统优先使用登录时记录的值，其次使用请求中的cos参数
+func newAuditActor(user *models.User, session *models.DeviceSession, ip string, cos string) auditActor {
+	actor := auditActor{IP: ip, ClientOS: helpers.ClientOS(strings.ToUpper(cos))}
+	if user != nil {
+		actor.UserId = user.ID
+		actor.Username = user.Username
+	}
+	if session != nil && session.ClientOS != "" {
+		actor.ClientOS = session.ClientOS
+	}
+	return actor
+}
+
+// 当前请求的操作者，需要在JWTAuthMiddleware之后使用
+func requestActor(c *gin.Context) auditActor {
+	return newAuditActor(currentUser(c), currentSession(c), c.ClientIP(), c.Query("cos"))
+}
+
+// 记录一个审计事件
+func (a auditActor) record(action string, target string, success bool, detail string) {
+	models.RecordAuditEvent(models.AuditEvent{
+		UserId:   a.UserId,
+		Username: a.Username,
+		Action:   action,
+		Target:   target,
+		IP:       a.IP,
+		ClientOS: a.ClientOS,
+		Success:  success,
+		Detail:   detail,
+	})
+}
+
+// 记录当前请求的一个成功的操作
+func audit(c *gin.Context, action string, target string, detail string) {
+	requestActor(c).record(action, target, true, detail)
+}
+
+type AuditListRequest struct {
+	Page     int    `json:"page" form:"page"`
+	PageSize int    `json:"page_size" form:"page_size"`
+	UserId   uint   `json:"user_id" form:"user_id"`
+	Username string `json:"username" form:"username"`
+	Action   string `json:"action" form:"action"`
+	IP       string `json:"ip" form:"ip"`
+	Target   string `json:"target" form:"target"`   // 按前缀匹配
+	Success  string `json:"success" form:"success"` // true/false，为空则不限制
+	From     int64  `json:"from" form:"from"`       // 开始时间，Unix时间戳，单位秒
+	To       int64  `json:"to" form:"to"`           // 结束时间，Unix时间戳，单位秒
+}
+
+func (r *AuditListRequest) filter() (models.AuditFilter, error) {
+	filter := models.AuditFilter{
+		UserId:   r.UserId,
+		Username: r.Username,
+		Action:   r.Action,
+		IP:       r.IP,
+		Target:   r.Target,
+		From:     r.From,
+		To:       r.To,
+	}
+	if r.Success != "" {
+		success, err := strconv.ParseBool(r.Success)
+		if err != nil {
+			return filter, fmt.Errorf("success参数错误: %s", r.Success)
+		}
+		filter.Success = &success
+	}
+	return filter, nil
+}
+
+// 查询审计事件，按时间倒序分页
+func HandleAuditList(c *gin.Context) {
+	var req AuditListRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	filter, err := req.filter()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.PageSize <= 0 || req.PageSize > 500 {
+		req.PageSize = 50
+	}
+	total, events, err := models.ListAuditEvents(filter, req.Page, req.PageSize)
+	if err != nil {
+		helpers.AppLogger.Errorf("查询审计事件失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询审计事件失败", Data: nil})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse[map[string]any]{Code: Success, Message: "", Data: map[string]any{"total": total, "events": events}})
+}
+
+// 文件名等内容可能以=、+、-、@、制表符或回车开头，在表格软件中会被当作公式执行，加上单引号避免
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// 以CSV格式导出符合条件的审计事件，按时间顺序
+func HandleAuditExport(c *gin.Context) {
+	var req AuditListRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	filter, err := req.filter()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%s.csv", time.Now().Format("20060102150405")))
+	c.Status(http.StatusOK)
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "time", "user_id", "username", "action", "target", "ip", "client_os", "success", "detail"})
+	err = models.EachAuditEvent(filter, 1000, func(events []*models.AuditEvent) error {
+		for _, e := range events {
+			w.Write([]string{
+				strconv.FormatUint(uint64(e.ID), 10),
+				time.Unix(e.CreatedAt, 0).Format(time.RFC3339),
+				strconv.FormatUint(uint64(e.UserId), 10),
+				csvCell(e.Username),
+				e.Action,
+				csvCell(e.Target),
+				e.IP,
+				string(e.ClientOS),
+				strconv.FormatBool(e.Success),
+				csvCell(e.Detail),
+			})
+		}
+		w.Flush()
+		return w.Error()
+	})
+	w.Flush()
+	if err != nil {
+		// 响应头已经发出，只能记录日志
+		helpers.AppLogger.Errorf("导出审计事件失败: %v", err)
+	}
+}
@@ -7,6 +7,8 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
 )
 
 type APIResponseCode int
@@ -14,8 +16,16 @@ type APIResponseCode int
 const (
 	Success APIResponseCode = iota
 	BadRequest
-	TerminalConnection = 3 // 用于WebSocket连接断开
-	ContinueTransfer   = 4 // 用于WebSocket继续传输
+	TerminalConnection    = 3  // 用于WebSocket连接断开
+	ContinueTransfer      = 4  // 用于WebSocket继续传输
+	ChecksumMismatch      = 5  // 服务器计算的checksum与客户端提供的不一致，需要重新上传
+	ChunkAck              = 6  // 分片已收到
+	ChunkNack             = 7  // 分片被拒绝（乱序、缺失或校验失败），需要从nextChunkIndex重新发送
+	QuotaExceeded         = 8  // 超出存储配额，上传被拒绝
+	Forbidden             = 9  // 没有权限
+	TooManyAttempts       = 10 // 登录失败次数过多，需要等待retryAfter秒后重试
+	TwoFactorRequired     = 11 // 账号启用了两步验证，需要带上otp重新登录
+	SharePasswordRequired = 12 // 分享链接需要访问密码，或者密码错误
 )
 
 type APIResponse[T any] struct {
@@ -25,14 +35,13 @@ type APIResponse[T any] struct {
 }
 
 type LoginUser struct {
-	ID       uint   `json:"id"`
-	Username string `json:"username"`
+	ID        uint   `json:"id"`
+	Username  string `json:"username"`
+	SessionId uint   `json:"sid"` // 设备会话ID，会话被撤销后Token失效
 	jwt.RegisteredClaims
 }
 
-var jwtSecret = []byte("backup-server-2508270000")
-
-// JWTAuthMiddleware 基于JWT的认证中间件--验证用户是否登录
+// JWTAuthMiddleware 基于JWT的认证中间件--验证用户是否登录，同时接受API Key
 func JWTAuthMiddleware() func(c *gin.Context) {
 	return func(c *gin.Context) {
 		authHeader := c.Request.Header.Get("Authorization")
@@ -41,30 +50,151 @@ func JWTAuthMiddleware() func(c *gin.Context) {
 			c.Abort()
 			return
 		}
-		// 按空格分割
-		parts := strings.Split(authHeader, ".")
-		if len(parts) != 3 {
+		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
+		// JWT由点分割为3段，API Key以固定前缀开头
+		if !strings.HasPrefix(tokenString, models.ApiKeyPrefix) && len(strings.Split(tokenString, ".")) != 3 {
 			c.JSON(http.StatusUnauthorized, APIResponse[any]{Code: BadRequest, Message: "Token格式有误", Data: nil})
 			c.Abort()
 			return
 		}
-		tokenString := strings.Replace(authHeader, "Bearer ", "", 1)
-		loginUser, err := ValidateJWT(tokenString)
+		user, session, apiKey, err := authenticate(tokenString, c.ClientIP())
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, APIResponse[any]{Code: BadRequest, Message: fmt.Sprintf("Token无效：%v", err), Data: nil})
 			c.Abort()
 			return
 		}
-		// helpers.AppLogger.Infof("Authenticated user: %s", loginUser.Username)
-		// 将当前请求的username信息保存到请求的上下文c上
-		c.Set("username", loginUser.Username)
-		c.Next() // 后续的处理函数可以用过c.Get("username")来获取当前请求的用户信息
+		// helpers.AppLogger.Infof("Authenticated user: %s", user.Username)
+		// 将当前请求的用户信息保存到请求的上下文c上
+		c.Set("username", user.Username)
+		c.Set("user", user)
+		if session != nil {
+			c.Set("session", session)
+		}
+		if apiKey != nil {
+			c.Set("apiKey", apiKey)
+		}
+		c.Next() // 后续的处理函数可以用过currentUser(c)来获取当前请求的用户信息，currentSession(c)获取当前的设备会话
+	}
+}
+
+// RequireScope 要求当前账号的角色拥有指定的权限，使用API Key访问时Key也要拥有该权限，需要在JWTAuthMiddleware之后使用
+func RequireScope(scope string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := checkScope(currentUser(c), currentApiKey(c), scope); err != nil {
+			c.JSON(http.StatusForbidden, APIResponse[any]{Code: Forbidden, Message: err.Error(), Data: nil})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 检查账号角色和API Key是否都拥有某个权限，apiKey为nil表示使用账号登录的Token
+func checkScope(user *models.User, apiKey *models.ApiKey, scope string) error {
+	if user == nil || !user.HasScope(scope) {
+		return fmt.Errorf("当前账号没有 %s 权限", scope)
+	}
+	if apiKey != nil && !apiKey.HasScope(scope) {
+		return fmt.Errorf("API Key没有 %s 权限", scope)
+	}
+	return nil
+}
+
+// LoginOnlyMiddleware 只允许使用账号登录的Token访问，不接受API Key，用于登录设备、两步验证和API Key的管理
+func LoginOnlyMiddleware() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if currentSession(c) == nil {
+			c.JSON(http.StatusForbidden, APIResponse[any]{Code: Forbidden, Message: "该接口不能使用API Key访问", Data: nil})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// AdminMiddleware 只允许管理员访问，需要在JWTAuthMiddleware之后使用
+func AdminMiddleware() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if err := checkScope(currentUser(c), currentApiKey(c), models.ScopeAdmin); err != nil {
+			c.JSON(http.StatusForbidden, APIResponse[any]{Code: Forbidden, Message: "需要管理员权限", Data: nil})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// 当前请求的登录用户，未登录返回nil
+func currentUser(c *gin.Context) *models.User {
+	if v, ok := c.Get("user"); ok {
+		return v.(*models.User)
+	}
+	return nil
+}
+
+// 当前请求的设备会话，未登录或者使用API Key访问时返回nil
+func currentSession(c *gin.Context) *models.DeviceSession {
+	if v, ok := c.Get("session"); ok {
+		return v.(*models.DeviceSession)
+	}
+	return nil
+}
+
+// 当前请求使用的API Key，使用账号登录的Token访问时返回nil
+func currentApiKey(c *gin.Context) *models.ApiKey {
+	if v, ok := c.Get("apiKey"); ok {
+		return v.(*models.ApiKey)
+	}
+	return nil
+}
+
+// 校验Token或API Key，并确认对应的用户仍然存在且没有被禁用
+// Token校验设备会话没有被撤销并更新会话的最后活动时间和IP，返回设备会话
+// API Key校验没有过期或被撤销并更新最后使用时间，返回API Key
+func authenticate(tokenString string, ip string) (*models.User, *models.DeviceSession, *models.ApiKey, error) {
+	if strings.HasPrefix(tokenString, models.ApiKeyPrefix) {
+		apiKey, err := models.GetApiKeyByKey(tokenString)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		user, err := activeUser(apiKey.UserId)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		apiKey.Touch()
+		return user, nil, apiKey, nil
+	}
+	loginUser, err := ValidateJWT(tokenString)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	user, err := activeUser(loginUser.ID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	session, err := models.GetDeviceSession(user.ID, loginUser.SessionId)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	session.Touch(ip)
+	return user, session, nil, nil
+}
+
+// 查询存在且没有被禁用的用户
+func activeUser(id uint) (*models.User, error) {
+	user, err := models.GetUserById(id)
+	if err != nil {
+		return nil, fmt.Errorf("用户不存在")
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("用户已被禁用")
 	}
+	return user, nil
 }
 
 func ValidateJWT(tokenString string) (*LoginUser, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &LoginUser{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
+		return helpers.JwtSecret, nil
 	})
 	if err != nil || !token.Valid {
 		return nil, fmt.Errorf("登录凭证校验失败: %v", err)
@@ -0,0 +1,52 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/qicfan/backup-server/models"
+)
+
+func TestCheckScope(t *testing.T) {
+	cases := []struct {
+		role   string
+		scopes string // API Key的权限，为空表示使用账号登录的Token
+		scope  string
+		want   bool
+	}{
+		{models.RoleAdmin, "", models.ScopeAdmin, true},
+		{models.RoleAdmin, "", models.ScopeUpload, true},
+		{models.RoleAdmin, "", models.ScopeRead, true},
+		{models.RoleMember, "", models.ScopeAdmin, false},
+		{models.RoleMember, "", models.ScopeUpload, true},
+		{models.RoleMember, "", models.ScopeRead, true},
+		{models.RoleReadOnly, "", models.ScopeUpload, false},
+		{models.RoleReadOnly, "", models.ScopeRead, true},
+		{models.RoleUploadOnly, "", models.ScopeUpload, true},
+		{models.RoleUploadOnly, "", models.ScopeRead, false},
+		{"unknown", "", models.ScopeRead, false},
+		// API Key的权限和账号的角色都满足才能访问
+		{models.RoleMember, "upload", models.ScopeUpload, true},
+		{models.RoleMember, "upload", models.ScopeRead, false},
+		{models.RoleMember, "read,upload", models.ScopeRead, true},
+		{models.RoleReadOnly, "upload", models.ScopeUpload, false},
+		{models.RoleAdmin, "read", models.ScopeAdmin, false},
+		// admin权限的Key包含其他权限，但不能超出账号的角色
+		{models.RoleAdmin, "admin", models.ScopeUpload, true},
+		{models.RoleMember, "admin", models.ScopeAdmin, false},
+		{models.RoleReadOnly, "admin", models.ScopeUpload, false},
+		{models.RoleMember, "uploads", models.ScopeUpload, false},
+	}
+	for _, c := range cases {
+		user := &models.User{Role: c.role}
+		var apiKey *models.ApiKey
+		if c.scopes != "" {
+			apiKey = &models.ApiKey{Scopes: c.scopes}
+		}
+		if got := checkScope(user, apiKey, c.scope) == nil; got != c.want {
+			t.Errorf("role=%s key=%q scope=%s: allowed = %v, want %v", c.role, c.scopes, c.scope, got, c.want)
+		}
+	}
+	if checkScope(nil, nil, models.ScopeRead) == nil {
+		t.Error("nil user: allowed, want denied")
+	}
+}
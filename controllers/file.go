@@ -1,9 +1,11 @@
 package controllers
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -26,7 +28,7 @@ type ExistsResponse struct {
 
 type DirOrFileEntry struct {
 	Name    string `json:"name"`
-	RelPath string `json:"relPath"` // 相对路径，不以 / 开头，相对helpers.UPLOAD_ROOT_DIR的路径
+	RelPath string `json:"relPath"` // 相对路径，不以 / 开头，相对用户照片目录的路径
 	IsDir   bool   `json:"isDir"`   // 是否文件夹
 }
 
@@ -52,19 +54,19 @@ func HandleCreateDir(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求的参数错误: " + err.Error(), Data: nil})
 		return
 	}
-	parent := req.Parent
-	name := req.Name
-	relPath := filepath.Join(parent, name)
-	if after, ok := strings.CutPrefix(relPath, "/"); ok {
-		relPath = after
+	relPath, absPath, err := currentUser(c).ResolvePath(filepath.Join(req.Parent, req.Name))
+	if err != nil {
+		helpers.AppLogger.Warnf("创建目录 %s/%s 被拒绝: %v", req.Parent, req.Name, err)
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
 	}
-	absPath := filepath.Join(helpers.UPLOAD_ROOT_DIR, relPath)
 	if err := os.MkdirAll(absPath, 0755); err != nil {
 		helpers.AppLogger.Errorf("Create dir error: %v", err)
 		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: map[string]interface{}{"path": relPath}})
 		return
 	}
 	helpers.AppLogger.Infof("Created dir: %s", absPath)
+	audit(c, models.AuditCreateDir, relPath, "")
 	c.JSON(http.StatusOK, APIResponse[map[string]string]{Code: Success, Message: "", Data: map[string]string{"path": relPath}})
 }
 
@@ -78,32 +80,34 @@ func HandleExists(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "参数错误: " + err.Error(), Data: nil})
 		return
 	}
+	user := currentUser(c)
 	var exists bool
 	if req.PathType == "1" {
-		fullPath := filepath.Join(helpers.UPLOAD_ROOT_DIR, req.Path)
+		_, fullPath, err := user.ResolvePath(req.Path)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+			return
+		}
 		exists = helpers.FileExists(fullPath)
 		helpers.AppLogger.Infof("Check exists: %s : %s : %v", req.Path, fullPath, exists)
 	} else {
 		// req.Path是Photos.fileUri
-		_, photoErr := models.GetPhotoByFileUri(req.Path)
+		_, photoErr := models.GetPhotoByFileUri(user.ID, req.Path)
 		exists = photoErr == nil
 		helpers.AppLogger.Infof("Check exists: %s : %v", req.Path, exists)
 	}
-	// if !exists {
-	// 	// 如果文件不存在则判断PreChecksum是否一致，如果PreChecksum有重复项责判断checksum是否一致，如果checksum也有重复项责判定为重复
-	// 	preChecksum := c.Request.Header.Get("X-Pre-Checksum")
-	// 	if preChecksum != "" {
-	// 		if exists, _ := models.CheckPhotoPreChecksum(preChecksum); exists {
-	// 			helpers.AppLogger.Infof("PreChecksum exists: %s", preChecksum)
-	// 			exists = true
-	// 		} else {
-	// 			helpers.AppLogger.Infof("PreChecksum not exists: %s", preChecksum)
-	// 			exists = false
-	// 		}
-	// 	}
-	// }
-
-	c.JSON(http.StatusOK, APIResponse[map[string]bool]{Code: Success, Message: "", Data: map[string]bool{"exists": exists}})
+	data := map[string]bool{"exists": exists}
+	if !exists {
+		// 如果文件不存在则判断大小和PreChecksum是否一致，一致则可能是重复的照片，客户端需要计算完整的checksum再确认
+		preChecksum := c.Request.Header.Get("X-Pre-Checksum")
+		size, _ := strconv.ParseInt(c.Request.Header.Get("X-Size"), 10, 64)
+		if preChecksum != "" && size > 0 {
+			maybeExists, _ := models.CheckPhotoPreChecksum(user.ID, preChecksum, size)
+			helpers.AppLogger.Infof("Check pre checksum exists: %s : %d : %v", preChecksum, size, maybeExists)
+			data["maybeExists"] = maybeExists
+		}
+	}
+	c.JSON(http.StatusOK, APIResponse[map[string]bool]{Code: Success, Message: "", Data: data})
 }
 
 // 检查checksum是否存在
@@ -114,7 +118,7 @@ func HandleChecksumExists(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "缺少X-Checksum头部", Data: nil})
 		return
 	}
-	exists, err := models.CheckPhotoChecksum(checksum)
+	exists, err := models.CheckPhotoChecksum(currentUser(c).ID, checksum)
 	if err != nil {
 		helpers.AppLogger.Errorf("Check checksum exists error: %v", err)
 		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: http.StatusInternalServerError, Message: err.Error(), Data: nil})
@@ -124,6 +128,68 @@ func HandleChecksumExists(c *gin.Context) {
 	c.JSON(http.StatusOK, APIResponse[map[string]bool]{Code: Success, Message: "", Data: map[string]bool{"exists": exists}})
 }
 
+// 一次批量查询最多允许的checksum和fileUri总数
+const maxBatchExistsItems = 50000
+
+type PreChecksumItem struct {
+	Size        int64  `json:"size"`        // 文件大小
+	PreChecksum string `json:"preChecksum"` // 文件64kb到65kb的sha1，见helpers.FileHeadSHA1
+}
+
+type BatchExistsRequest struct {
+	Checksums    []string          `json:"checksums"`    // 照片的sha1列表
+	FileUris     []string          `json:"fileUris"`     // 鸿蒙系统的照片资源URI列表
+	PreChecksums []PreChecksumItem `json:"preChecksums"` // 文件大小和部分sha1，用于在计算完整sha1之前找出可能重复的照片
+}
+
+type BatchExistsResponse struct {
+	Checksums    map[string]string   `json:"checksums"`    // 已存在的checksum => 照片路径
+	FileUris     map[string]string   `json:"fileUris"`     // 已存在的fileUri => 照片路径
+	PreChecksums map[string][]string `json:"preChecksums"` // 大小和preChecksum都相同的preChecksum => 可能重复的照片的checksum列表，客户端计算完整sha1后比对
+}
+
+// 批量检查checksum和fileUri是否存在，用于备份前一次性过滤已经备份过的照片
+// return: data.checksums 和 data.fileUris，只包含已存在的项，值为照片的相对路径
+func HandleBatchExists(c *gin.Context) {
+	var req BatchExistsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		helpers.AppLogger.Warnf("Invalid request: %v", err)
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	if len(req.Checksums)+len(req.FileUris)+len(req.PreChecksums) > maxBatchExistsItems {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: fmt.Sprintf("一次最多查询 %d 项", maxBatchExistsItems), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	checksums, err := models.GetPhotoPathsByChecksums(user.ID, req.Checksums)
+	if err != nil {
+		helpers.AppLogger.Errorf("Batch check checksum exists error: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	fileUris, err := models.GetPhotoPathsByFileUris(user.ID, req.FileUris)
+	if err != nil {
+		helpers.AppLogger.Errorf("Batch check fileUri exists error: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	preChecksums := make([]string, 0, len(req.PreChecksums))
+	sizes := make([]int64, 0, len(req.PreChecksums))
+	for _, item := range req.PreChecksums {
+		preChecksums = append(preChecksums, item.PreChecksum)
+		sizes = append(sizes, item.Size)
+	}
+	candidates, err := models.GetPhotoChecksumsByPreChecksums(user.ID, preChecksums, sizes)
+	if err != nil {
+		helpers.AppLogger.Errorf("Batch check pre checksum exists error: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	helpers.AppLogger.Infof("Batch check exists: checksum %d/%d, fileUri %d/%d, preChecksum %d/%d", len(checksums), len(req.Checksums), len(fileUris), len(req.FileUris), len(candidates), len(req.PreChecksums))
+	c.JSON(http.StatusOK, APIResponse[BatchExistsResponse]{Code: Success, Message: "", Data: BatchExistsResponse{Checksums: checksums, FileUris: fileUris, PreChecksums: candidates}})
+}
+
 // 目录列表
 // path: 目录的路径
 // return: data.entries 目录下的子目录列表
@@ -134,12 +200,11 @@ func HandleListDir(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, APIResponse[interface{}]{Code: BadRequest, Message: "参数错误: " + err.Error(), Data: nil})
 		return
 	}
-	path := req.Path
-	if strings.HasPrefix(path, "/") {
-		path = strings.TrimLeft(path, "/")
+	path, absPath, err := currentUser(c).ResolvePath(req.Path)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[interface{}]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
 	}
-	// 构造绝路路径
-	absPath := filepath.Join(helpers.UPLOAD_ROOT_DIR, path)
 	helpers.AppLogger.Infof("Listing dir: %s => %s", path, absPath)
 	entries, err := os.ReadDir(absPath)
 	if err != nil {
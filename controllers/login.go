@@ -1,56 +1,161 @@
 package controllers
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
 )
 
 type LoginRequest struct {
-	Username string `json:"username" form:"username"`
-	Password string `json:"password" form:"password"`
+	Username   string `json:"username" form:"username"`
+	Password   string `json:"password" form:"password"`
+	DeviceName string `json:"deviceName" form:"deviceName"` // 设备名称，显示在登录设备列表中
+	Cos        string `json:"cos" form:"cos"`               // 客户端操作系统：HMOS/ANDROID/IOS
+	Otp        string `json:"otp" form:"otp"`               // 两步验证码或者恢复码，账号启用了两步验证时必填
 }
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token        string `json:"token"`        // 访问Token，放在Authorization头中
+	ExpiresIn    int64  `json:"expiresIn"`    // 访问Token的有效期，单位秒
+	RefreshToken string `json:"refreshToken"` // 刷新Token，访问Token过期后用来换取新的Token，只能使用一次
 }
 
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken" form:"refreshToken" binding:"required"`
+}
+
+// 访问Token的有效期，过期后客户端使用刷新Token换取新的Token
+const accessTokenTTL = 2 * time.Hour
+
+// 刷新Token的有效期，超过该时间没有刷新则需要重新登录
+const refreshTokenTTL = 30 * 24 * time.Hour
+
 func HandleLogin(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBind(&req); err != nil {
 		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: fmt.Sprintf("参数错误：%v", err), Data: nil})
 		return
 	}
-	helpers.AppLogger.Infof("Login attempt: %s, %s", req.Username, req.Password)
-	envUser := os.Getenv("USERNAME")
-	if envUser == "" {
-		envUser = "admin"
-	}
-	envPass := os.Getenv("PASSWORD")
-	if envPass == "" {
-		envPass = "admin"
+	ip := c.ClientIP()
+	actor := newAuditActor(nil, nil, ip, req.Cos)
+	actor.Username = req.Username
+	if wait := reserveLoginAttempt(ip, req.Username); wait > 0 {
+		retryAfter := int64(wait.Seconds()) + 1
+		helpers.AuthLogger.Warnf("登录被限制: 用户名 %s, IP %s, %d秒后重试", req.Username, ip, retryAfter)
+		actor.record(models.AuditLoginFailed, req.Username, false, "登录失败次数过多")
+		c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+		c.JSON(http.StatusTooManyRequests, APIResponse[map[string]int64]{Code: TooManyAttempts, Message: fmt.Sprintf("登录失败次数过多，请%d秒后重试", retryAfter), Data: map[string]int64{"retryAfter": retryAfter}})
+		return
 	}
-	helpers.AppLogger.Infof("ENV attempt: %s, %s", envUser, envPass)
-	if req.Username != envUser || req.Password != envPass {
+	user, err := models.GetUserByUsername(req.Username)
+	if err != nil || !user.CheckPassword(req.Password) {
+		// 失败已经在reserveLoginAttempt中记录
+		helpers.AuthLogger.Warnf("登录失败: 用户名 %s, IP %s, 用户名或密码错误", req.Username, ip)
+		if user != nil {
+			actor.UserId = user.ID
+		}
+		actor.record(models.AuditLoginFailed, req.Username, false, "用户名或密码错误")
 		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "用户名或密码错误", Data: nil})
 		return
 	}
-	claims := &LoginUser{
-		ID:       1,
-		Username: req.Username,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(365 * 24 * time.Hour)),
-		},
+	actor.UserId = user.ID
+	if user.Disabled {
+		helpers.AuthLogger.Warnf("登录失败: 用户名 %s, IP %s, 用户已被禁用", req.Username, ip)
+		actor.record(models.AuditLoginFailed, req.Username, false, "用户已被禁用")
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "用户已被禁用", Data: nil})
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtSecret)
+	if user.TotpEnabled {
+		if req.Otp == "" {
+			// 密码正确，只是还需要验证码，不计为失败
+			releaseLoginAttempt(ip, req.Username)
+			helpers.AuthLogger.Infof("需要两步验证: 用户名 %s, IP %s", req.Username, ip)
+			c.JSON(http.StatusOK, APIResponse[any]{Code: TwoFactorRequired, Message: "请输入两步验证码", Data: nil})
+			return
+		}
+		if !user.VerifySecondFactor(req.Otp) {
+			helpers.AuthLogger.Warnf("登录失败: 用户名 %s, IP %s, 两步验证码错误", req.Username, ip)
+			actor.record(models.AuditLoginFailed, req.Username, false, "两步验证码错误")
+			c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "两步验证码错误", Data: nil})
+			return
+		}
+	}
+	recordLoginSuccess(ip, req.Username)
+	session, err := models.CreateDeviceSession(user.ID, req.DeviceName, helpers.ClientOS(strings.ToUpper(req.Cos)), ip)
 	if err != nil {
+		helpers.AppLogger.Errorf("创建设备会话失败: %v", err)
 		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "Token生成失败", Data: nil})
 		return
 	}
-	c.JSON(http.StatusOK, APIResponse[map[string]string]{Code: Success, Message: "", Data: map[string]string{"token": tokenString}})
+	tokenString, err := signAccessToken(user, session)
+	if err != nil {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "Token生成失败", Data: nil})
+		return
+	}
+	refreshToken, err := models.CreateRefreshToken(session, refreshTokenTTL)
+	if err != nil {
+		helpers.AppLogger.Errorf("签发刷新Token失败: %v", err)
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "Token生成失败", Data: nil})
+		return
+	}
+	helpers.AuthLogger.Infof("登录成功: 用户名 %s, IP %s, 设备 %d", user.Username, ip, session.ID)
+	actor.record(models.AuditLogin, user.Username, true, fmt.Sprintf("session=%d device=%s", session.ID, session.Name))
+	c.JSON(http.StatusOK, APIResponse[LoginResponse]{Code: Success, Message: "", Data: LoginResponse{Token: tokenString, ExpiresIn: int64(accessTokenTTL.Seconds()), RefreshToken: refreshToken}})
+}
+
+// 使用刷新Token换取新的访问Token和刷新Token，旧的刷新Token立即失效
+func HandleRefreshToken(c *gin.Context) {
+	var req RefreshTokenRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: fmt.Sprintf("参数错误：%v", err), Data: nil})
+		return
+	}
+	rotated, refreshToken, err := models.RotateRefreshToken(req.RefreshToken, refreshTokenTTL)
+	if err != nil {
+		if !errors.Is(err, models.ErrRefreshTokenInvalid) {
+			helpers.AppLogger.Errorf("刷新Token失败: %v", err)
+		}
+		c.JSON(http.StatusUnauthorized, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	session, err := models.GetDeviceSession(rotated.UserId, rotated.SessionId)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	user, err := models.GetUserById(session.UserId)
+	if err != nil || user.Disabled {
+		c.JSON(http.StatusUnauthorized, APIResponse[any]{Code: BadRequest, Message: "用户不存在或已被禁用", Data: nil})
+		return
+	}
+	session.Touch(c.ClientIP())
+	tokenString, err := signAccessToken(user, session)
+	if err != nil {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "Token生成失败", Data: nil})
+		return
+	}
+	newAuditActor(user, session, c.ClientIP(), "").record(models.AuditTokenRefresh, user.Username, true, fmt.Sprintf("session=%d", session.ID))
+	c.JSON(http.StatusOK, APIResponse[LoginResponse]{Code: Success, Message: "", Data: LoginResponse{Token: tokenString, ExpiresIn: int64(accessTokenTTL.Seconds()), RefreshToken: refreshToken}})
+}
+
+// 为设备会话签发访问Token
+func signAccessToken(user *models.User, session *models.DeviceSession) (string, error) {
+	claims := &LoginUser{
+		ID:        user.ID,
+		Username:  user.Username,
+		SessionId: session.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(helpers.JwtSecret)
 }
@@ -0,0 +1,142 @@
+package controllers
+
+import (
+	"sync"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+)
+
+// 登录失败的限制策略
+// 失败次数超过freeFailures后，每次失败需要等待的时间按指数增长（1秒、2秒、4秒...），最长maxBackoff
+// 失败次数达到lockFailures后锁定lockDuration
+type loginLimit struct {
+	freeFailures int
+	lockFailures int
+	maxBackoff   time.Duration
+	lockDuration time.Duration
+}
+
+// 同一个用户名的限制
+var usernameLoginLimit = loginLimit{freeFailures: 3, lockFailures: 10, maxBackoff: time.Minute, lockDuration: 15 * time.Minute}
+
+// 同一个IP的限制，同一个IP后面可能有多个用户，限制比用户名宽松
+var ipLoginLimit = loginLimit{freeFailures: 10, lockFailures: 30, maxBackoff: time.Minute, lockDuration: 30 * time.Minute}
+
+// 最后一次失败超过该时间后，失败次数清零
+const loginAttemptWindow = time.Hour
+
+// 一个用户名或IP的登录失败记录
+type loginAttempt struct {
+	failures    int
+	lastFailure time.Time
+	nextAllowed time.Time // 在该时间之前拒绝登录
+}
+
+var loginAttempts = make(map[string]*loginAttempt)
+var loginAttemptsLock sync.Mutex
+
+func usernameAttemptKey(username string) string {
+	return "user:" + username
+}
+
+func ipAttemptKey(ip string) string {
+	return "ip:" + ip
+}
+
+// 检查是否允许登录，允许时先把本次尝试计为一次失败，不允许时返回需要等待的时间
+// 检查和计数在同一个锁内完成，并发的请求在密码校验完成之前就会被限制，无法通过同时发送大量请求绕过限制
+// 验证成功后调用recordLoginSuccess或releaseLoginAttempt退还本次计数
+func reserveLoginAttempt(ip string, username string) time.Duration {
+	loginAttemptsLock.Lock()
+	defer loginAttemptsLock.Unlock()
+	var wait time.Duration
+	for _, key := range []string{ipAttemptKey(ip), usernameAttemptKey(username)} {
+		if a, ok := loginAttempts[key]; ok {
+			wait = max(wait, time.Until(a.nextAllowed))
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	ipLocked := ipLoginLimit.fail(ipAttemptKey(ip))
+	usernameLocked := usernameLoginLimit.fail(usernameAttemptKey(username))
+	if ipLocked {
+		helpers.AuthLogger.Warnf("IP %s 登录失败次数过多，锁定 %s", ip, ipLoginLimit.lockDuration)
+	}
+	if usernameLocked {
+		helpers.AuthLogger.Warnf("用户名 %s 登录失败次数过多，锁定 %s", username, usernameLoginLimit.lockDuration)
+	}
+	return 0
+}
+
+// 登录成功后清除用户名的失败记录，IP只退还本次预先记录的失败
+// 不能清除IP的失败记录，否则拥有一个有效账号就可以重置自己IP的限制
+func recordLoginSuccess(ip string, username string) {
+	loginAttemptsLock.Lock()
+	defer loginAttemptsLock.Unlock()
+	ipLoginLimit.refund(ipAttemptKey(ip))
+	delete(loginAttempts, usernameAttemptKey(username))
+}
+
+// 验证通过但还没有完成登录（例如需要两步验证码），退还本次预先记录的失败
+func releaseLoginAttempt(ip string, username string) {
+	loginAttemptsLock.Lock()
+	defer loginAttemptsLock.Unlock()
+	ipLoginLimit.refund(ipAttemptKey(ip))
+	usernameLoginLimit.refund(usernameAttemptKey(username))
+}
+
+// 累加失败次数并计算下次允许登录的时间，调用方需要持有loginAttemptsLock，达到锁定次数时返回true
+func (l loginLimit) fail(key string) bool {
+	now := time.Now()
+	a, ok := loginAttempts[key]
+	if !ok || now.Sub(a.lastFailure) > loginAttemptWindow {
+		a = &loginAttempt{}
+		loginAttempts[key] = a
+	}
+	a.failures++
+	a.lastFailure = now
+	return l.update(a)
+}
+
+// 退还一次失败，调用方需要持有loginAttemptsLock
+func (l loginLimit) refund(key string) {
+	a, ok := loginAttempts[key]
+	if !ok {
+		return
+	}
+	a.failures--
+	if a.failures <= 0 {
+		delete(loginAttempts, key)
+		return
+	}
+	l.update(a)
+}
+
+// 根据失败次数计算下次允许登录的时间，达到锁定次数时返回true
+func (l loginLimit) update(a *loginAttempt) bool {
+	switch {
+	case a.failures >= l.lockFailures:
+		a.nextAllowed = a.lastFailure.Add(l.lockDuration)
+		return true
+	case a.failures > l.freeFailures:
+		backoff := time.Second << min(a.failures-l.freeFailures-1, 30)
+		a.nextAllowed = a.lastFailure.Add(min(backoff, l.maxBackoff))
+	default:
+		a.nextAllowed = time.Time{}
+	}
+	return false
+}
+
+// 清理已经过期的失败记录
+func CleanupLoginAttempts() {
+	loginAttemptsLock.Lock()
+	defer loginAttemptsLock.Unlock()
+	now := time.Now()
+	for key, a := range loginAttempts {
+		if now.After(a.nextAllowed) && now.Sub(a.lastFailure) > loginAttemptWindow {
+			delete(loginAttempts, key)
+		}
+	}
+}
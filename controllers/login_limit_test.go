@@ -0,0 +1,143 @@
+package controllers
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/sirupsen/logrus"
+)
+
+func resetLoginAttempts(t *testing.T) {
+	t.Helper()
+	helpers.AuthLogger = logrus.New()
+	helpers.AuthLogger.SetOutput(io.Discard)
+	loginAttemptsLock.Lock()
+	loginAttempts = make(map[string]*loginAttempt)
+	loginAttemptsLock.Unlock()
+}
+
+func loginFailures(key string) int {
+	loginAttemptsLock.Lock()
+	defer loginAttemptsLock.Unlock()
+	if a, ok := loginAttempts[key]; ok {
+		return a.failures
+	}
+	return 0
+}
+
+func TestLoginLimitUpdate(t *testing.T) {
+	limit := loginLimit{freeFailures: 3, lockFailures: 12, maxBackoff: time.Minute, lockDuration: 15 * time.Minute}
+	now := time.Now()
+	cases := []struct {
+		failures int
+		wait     time.Duration
+		locked   bool
+	}{
+		{1, 0, false},
+		{3, 0, false},
+		{4, time.Second, false},
+		{5, 2 * time.Second, false},
+		{6, 4 * time.Second, false},
+		{9, 32 * time.Second, false},
+		{10, time.Minute, false},
+		{12, 15 * time.Minute, true},
+		{20, 15 * time.Minute, true},
+	}
+	for _, c := range cases {
+		a := &loginAttempt{failures: c.failures, lastFailure: now}
+		locked := limit.update(a)
+		var wait time.Duration
+		if !a.nextAllowed.IsZero() {
+			wait = a.nextAllowed.Sub(now)
+		}
+		if locked != c.locked || wait != c.wait {
+			t.Errorf("failures=%d: locked=%v wait=%v, want locked=%v wait=%v", c.failures, locked, wait, c.locked, c.wait)
+		}
+	}
+}
+
+func TestReserveLoginAttempt(t *testing.T) {
+	resetLoginAttempts(t)
+	ip, username := "10.0.0.1", "admin"
+	for i := 0; i < usernameLoginLimit.freeFailures; i++ {
+		if wait := reserveLoginAttempt(ip, username); wait != 0 {
+			t.Fatalf("attempt %d: wait = %v, want 0", i+1, wait)
+		}
+	}
+	// 超过免费次数后，下一次尝试需要等待
+	if wait := reserveLoginAttempt(ip, username); wait != 0 {
+		t.Fatalf("attempt 4: wait = %v, want 0", wait)
+	}
+	if wait := reserveLoginAttempt(ip, username); wait <= 0 {
+		t.Fatalf("attempt 5: wait = %v, want > 0", wait)
+	}
+	// 被拒绝的尝试不计数
+	if got := loginFailures(usernameAttemptKey(username)); got != 4 {
+		t.Errorf("username failures = %d, want 4", got)
+	}
+}
+
+func TestReserveLoginAttemptConcurrent(t *testing.T) {
+	resetLoginAttempts(t)
+	// 同时发送的请求在校验密码之前就会被计数，最多只有免费次数+1个请求能通过检查
+	var allowed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if reserveLoginAttempt("10.0.0.1", "admin") == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if want := usernameLoginLimit.freeFailures + 1; allowed != want {
+		t.Errorf("allowed = %d, want %d", allowed, want)
+	}
+}
+
+func TestLoginSuccessKeepsIPFailures(t *testing.T) {
+	resetLoginAttempts(t)
+	ip := "10.0.0.1"
+	// 攻击者猜测其他账号的密码
+	for i := 0; i < 3; i++ {
+		reserveLoginAttempt(ip, "victim")
+	}
+	// 再用自己的账号登录成功，只清除自己账号的记录，IP的失败记录只退还本次
+	reserveLoginAttempt(ip, "attacker")
+	recordLoginSuccess(ip, "attacker")
+	if got := loginFailures(ipAttemptKey(ip)); got != 3 {
+		t.Errorf("ip failures = %d, want 3", got)
+	}
+	if got := loginFailures(usernameAttemptKey("attacker")); got != 0 {
+		t.Errorf("attacker failures = %d, want 0", got)
+	}
+	if got := loginFailures(usernameAttemptKey("victim")); got != 3 {
+		t.Errorf("victim failures = %d, want 3", got)
+	}
+}
+
+func TestReleaseLoginAttempt(t *testing.T) {
+	resetLoginAttempts(t)
+	ip, username := "10.0.0.1", "admin"
+	for i := 0; i < 10; i++ {
+		if wait := reserveLoginAttempt(ip, username); wait != 0 {
+			t.Fatalf("attempt %d: wait = %v, want 0", i+1, wait)
+		}
+		// 密码正确但需要两步验证码，不计为失败
+		releaseLoginAttempt(ip, username)
+	}
+	if got := loginFailures(usernameAttemptKey(username)); got != 0 {
+		t.Errorf("username failures = %d, want 0", got)
+	}
+	if got := loginFailures(ipAttemptKey(ip)); got != 0 {
+		t.Errorf("ip failures = %d, want 0", got)
+	}
+}
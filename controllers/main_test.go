@@ -0,0 +1,31 @@
+package controllers
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+	"github.com/sirupsen/logrus"
+)
+
+// 使用临时目录中的数据库运行测试
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "backup-server-controllers")
+	if err != nil {
+		panic(err)
+	}
+	helpers.RootDir = dir
+	helpers.UPLOAD_ROOT_DIR = filepath.Join(dir, "upload")
+	os.MkdirAll(filepath.Join(dir, "config"), 0755)
+	helpers.AppLogger = logrus.New()
+	helpers.AppLogger.SetOutput(io.Discard)
+	helpers.AuthLogger = helpers.AppLogger
+	helpers.InitDb()
+	models.Migrate()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
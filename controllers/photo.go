@@ -5,6 +5,8 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -15,6 +17,9 @@ import (
 	"github.com/qicfan/backup-server/models"
 )
 
+// 转码的目标扩展名，如 .jpg，为空表示不修改扩展名
+var transcodeExtPattern = regexp.MustCompile(`^(\.[A-Za-z0-9]{1,8})?$`)
+
 type DownloadQuery struct {
 	Path          string `json:"path" form:"path"`                       // 相对路径
 	Cos           string `json:"cos" form:"cos"`                         // 客户端操作系统
@@ -27,7 +32,7 @@ type DownloadQuery struct {
 // 查询图片的的缩略图，构造一个请求
 // http://yourserver/photo/thumbnail/MovieBackup%2FHuawei%20Pura%20X%2F2025%2F8%2F27%2F1.jpg/100x100
 func HandleGetThumbnail(c *gin.Context) {
-	path := c.Param("path") // 相对路径，不以 / 开头，相对helpers.UPLOAD_ROOT_DIR的路径，需要做base64_decode
+	path := c.Param("path") // 相对路径，不以 / 开头，相对用户照片目录的路径，需要做base64_decode
 	urldecodePath, _ := url.QueryUnescape(path)
 	decodedPath, err := helpers.Base64Decode(urldecodePath)
 	if err != nil {
@@ -35,9 +40,18 @@ func HandleGetThumbnail(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "路径解码失败", Data: nil})
 		return
 	}
-	path = decodedPath
+	user := currentUser(c)
+	relPath, _, err := user.ResolvePath(decodedPath)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	serveThumbnail(c, user.LibraryPath(relPath), c.Param("size"))
+}
+
+// 返回照片或视频的缩略图，path是相对helpers.UPLOAD_ROOT_DIR的路径，size为100x100格式
+func serveThumbnail(c *gin.Context, path string, size string) {
 	fullPath := filepath.Join(helpers.UPLOAD_ROOT_DIR, path)
-	size := c.Param("size") // 尺寸 100x100格式
 	helpers.AppLogger.Infof("获取缩略图: %s, 尺寸: %s", path, size)
 	// 检查path是否存在
 	if !helpers.FileExists(fullPath) {
@@ -47,7 +61,7 @@ func HandleGetThumbnail(c *gin.Context) {
 	}
 	// 解析尺寸参数
 	var width, height int
-	_, err = fmt.Sscanf(size, "%dx%d", &width, &height)
+	_, err := fmt.Sscanf(size, "%dx%d", &width, &height)
 	if err != nil || width <= 0 || height <= 0 {
 		helpers.AppLogger.Errorf("尺寸参数错误: %v", err)
 		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "尺寸参数错误", Data: nil})
@@ -91,14 +105,31 @@ func HandlePhotoDownload(c *gin.Context) {
 	if c.ShouldBind(&queryParams) == nil {
 		helpers.AppLogger.Infof("下载请求参数: %+v", queryParams)
 	}
-	path := queryParams.Path // 相对路径，不以 / 开头，相对helpers.UPLOAD_ROOT_DIR的路径，需要做urldecode
-	path = strings.TrimPrefix(path, string(os.PathSeparator))
+	downloadPhoto(c, currentUser(c), queryParams)
+}
+
+// 下载用户目录下的照片或者视频，需要时先转码
+func downloadPhoto(c *gin.Context, user *models.User, queryParams DownloadQuery) {
+	// 相对用户照片目录的路径
+	path, fullPath, err := user.ResolvePath(queryParams.Path)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
 	clientOS := helpers.ClientOS(queryParams.Cos)
 	if clientOS == helpers.UNKNOW {
 		clientOS = helpers.HMOS // 默认HMOS
 	}
 	isLive := queryParams.Live == 1
-	fullPath := filepath.Join(helpers.UPLOAD_ROOT_DIR, path)
+	if queryParams.Transcode == 1 {
+		// 扩展名会拼接到文件路径上，只允许 .jpg 这样的格式
+		imageExtInvalid := helpers.IsImage(fullPath) && !transcodeExtPattern.MatchString(queryParams.TransImageExt)
+		videoExtInvalid := (helpers.IsVideo(fullPath) || isLive) && !transcodeExtPattern.MatchString(queryParams.TransVideoExt)
+		if imageExtInvalid || videoExtInvalid {
+			c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "转码格式错误", Data: nil})
+			return
+		}
+	}
 	helpers.AppLogger.Infof("下载文件: %s", fullPath)
 	// 检查文件是否存在
 	if !helpers.FileExists(fullPath) {
@@ -106,17 +137,17 @@ func HandlePhotoDownload(c *gin.Context) {
 		return
 	}
 	// 查找photo
-	photo, err := models.GetPhotoByPath(path)
+	photo, err := models.GetPhotoByPath(user.ID, path)
 	if err != nil {
 		helpers.AppLogger.Errorf("查找照片失败: %v", err)
 		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查找照片失败", Data: nil})
 		return
 	}
-	var destPath = path
+	var destPath = user.LibraryPath(path)
 	var destFullPath = fullPath
 	var livePhotoVideoPath = photo.LivePhotoVideoPath
 	var size int64 = 0
-	// var preChecksum string
+	var preChecksum string
 	var checksum string
 	if helpers.IsImage(fullPath) && queryParams.Transcode == 1 {
 		if isLive {
@@ -126,7 +157,7 @@ func HandlePhotoDownload(c *gin.Context) {
 		var transErr error
 		// 进行图片转码
 		helpers.AppLogger.Infof("进行图片转码: %s", path)
-		if destPath, destFullPath, transErr = helpers.TransImage(path, queryParams.TransImageExt); transErr != nil {
+		if destPath, destFullPath, transErr = helpers.TransImage(user.LibraryPath(path), queryParams.TransImageExt); transErr != nil {
 			helpers.AppLogger.Errorf("图片转码失败: %v", transErr)
 			c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "图片转码失败", Data: nil})
 			return
@@ -138,7 +169,7 @@ func HandlePhotoDownload(c *gin.Context) {
 		// 进行视频转码
 		var transErr error
 		helpers.AppLogger.Infof("进行视频转码: %s", path)
-		if destPath, destFullPath, transErr = helpers.TransVideo(path, queryParams.TransVideoExt); transErr != nil {
+		if destPath, destFullPath, transErr = helpers.TransVideo(user.LibraryPath(path), queryParams.TransVideoExt); transErr != nil {
 			helpers.AppLogger.Errorf("视频转码失败: %v", transErr)
 			c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "视频转码失败", Data: nil})
 			return
@@ -147,6 +178,10 @@ func HandlePhotoDownload(c *gin.Context) {
 		}
 	}
 	if queryParams.Transcode == 1 {
+		// 转码函数返回的是相对helpers.UPLOAD_ROOT_DIR的路径，入库时转换为相对用户目录的路径
+		if relPath, err := filepath.Rel(user.LibraryDir(), destPath); err == nil {
+			destPath = relPath
+		}
 		if fileInfo, err := os.Stat(destFullPath); err == nil {
 			size = fileInfo.Size()
 		}
@@ -154,10 +189,10 @@ func HandlePhotoDownload(c *gin.Context) {
 		mtime := time.Unix(photo.MTime, 0)
 		ctime := time.Unix(photo.CTime, 0)
 		os.Chtimes(destFullPath, mtime, ctime)
-		// preChecksum, _ = helpers.FileHeadSHA1(destFullPath)
+		preChecksum, _ = helpers.FileHeadSHA1(destFullPath)
 		checksum, _ = helpers.FileSHA1(destFullPath)
 		// 写入数据库
-		if err := models.InsertPhoto(photo.Name, destPath, size, photo.Type, livePhotoVideoPath, "", photo.MTime, photo.CTime, checksum, photo.ID); err != nil {
+		if err := models.InsertPhoto(user.ID, photo.Name, destPath, size, photo.Type, livePhotoVideoPath, "", photo.MTime, photo.CTime, checksum, preChecksum, photo.ID); err != nil {
 			helpers.AppLogger.Errorf("将转码的Photo插入数据库失败: %v", err)
 			c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "更新照片路径失败", Data: nil})
 			return
@@ -168,11 +203,63 @@ func HandlePhotoDownload(c *gin.Context) {
 }
 
 type PhotoListRequest struct {
-	Page     int `json:"page" form:"page"`
-	PageSize int `json:"page_size" form:"page_size"`
+	Page     int    `json:"page" form:"page"`
+	PageSize int    `json:"page_size" form:"page_size"`
+	Type     int    `json:"type" form:"type"`       // 照片类型，1-普通照片，2-视频，3-动态照片，0或不传不限制
+	From     int64  `json:"from" form:"from"`       // 拍摄时间的开始，Unix时间戳，单位秒
+	To       int64  `json:"to" form:"to"`           // 拍摄时间的结束，Unix时间戳，单位秒
+	Dir      string `json:"dir" form:"dir"`         // 只返回该目录（包括子目录）下的照片
+	Name     string `json:"name" form:"name"`       // 文件名包含该字符串
+	Camera   string `json:"camera" form:"camera"`   // 相机厂商或型号包含该字符串
+	HasGPS   string `json:"has_gps" form:"has_gps"` // true/false，为空则不限制
+	Sort     string `json:"sort" form:"sort"`       // 排序字段：taken_at（默认）、mtime、ctime、created_at、name、size
+	Order    string `json:"order" form:"order"`     // 排序方向：desc（默认）、asc
+	Cursor   string `json:"cursor" form:"cursor"`   // 上次返回的next_cursor或prev_cursor，传入时忽略page、sort和order，筛选条件需要与上次相同
+}
+
+// 校验请求参数并生成查询条件和排序
+func (r *PhotoListRequest) query(user *models.User) (models.PhotoFilter, models.PhotoSort, error) {
+	filter := models.PhotoFilter{
+		Type:   models.PhotoType(r.Type),
+		From:   r.From,
+		To:     r.To,
+		Name:   r.Name,
+		Camera: r.Camera,
+	}
+	sort := models.PhotoSort{Field: r.Sort}
+	if r.Type < 0 || r.Type > int(models.PhotoTypeLivePhoto) {
+		return filter, sort, fmt.Errorf("type参数错误: %d", r.Type)
+	}
+	if r.Dir != "" {
+		dir, _, err := user.ResolvePath(r.Dir)
+		if err != nil {
+			return filter, sort, err
+		}
+		if dir != "." {
+			filter.Dir = dir
+		}
+	}
+	if r.HasGPS != "" {
+		hasGPS, err := strconv.ParseBool(r.HasGPS)
+		if err != nil {
+			return filter, sort, fmt.Errorf("has_gps参数错误: %s", r.HasGPS)
+		}
+		filter.HasGPS = &hasGPS
+	}
+	if _, ok := models.PhotoSortColumns[r.Sort]; r.Sort != "" && !ok {
+		return filter, sort, fmt.Errorf("sort参数错误: %s", r.Sort)
+	}
+	switch strings.ToLower(r.Order) {
+	case "", "desc":
+	case "asc":
+		sort.Asc = true
+	default:
+		return filter, sort, fmt.Errorf("order参数错误: %s", r.Order)
+	}
+	return filter, sort, nil
 }
 
-// 照片列表
+// 照片列表，支持按类型、拍摄时间、目录、文件名、相机和是否有拍摄地点筛选，总数也按相同的条件统计
 func HandlePhotoList(c *gin.Context) {
 	var req PhotoListRequest
 	if err := c.ShouldBind(&req); err != nil {
@@ -180,15 +267,77 @@ func HandlePhotoList(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误", Data: nil})
 		return
 	}
-	helpers.AppLogger.Infof("查询照片列表: 页码 %d, 每页 %d", req.Page, req.PageSize)
-	var total, photos, err = models.ListPhotos(req.Page, req.PageSize)
+	filter, sort, err := req.query(currentUser(c))
 	if err != nil {
-		helpers.AppLogger.Errorf("查询照片列表失败: %v", err)
-		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询照片列表失败", Data: nil})
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
 		return
 	}
+	if req.Page <= 0 {
+		req.Page = 1
+	}
+	if req.PageSize <= 0 {
+		req.PageSize = 50
+	}
+	var total int64
+	var photos []*models.Photo
+	// 游标方向上（以及相反方向上）是否还有照片
+	var hasNext, hasPrev bool
+	if req.Cursor != "" {
+		cursor, err := models.DecodePhotoCursor(req.Cursor)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+			return
+		}
+		helpers.AppLogger.Infof("查询照片列表: 游标 %s, 每页 %d", req.Cursor, req.PageSize)
+		var more bool
+		total, photos, more, err = models.ListPhotosByCursor(currentUser(c).ID, filter, *cursor, req.PageSize)
+		if err != nil {
+			helpers.AppLogger.Errorf("查询照片列表失败: %v", err)
+			c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询照片列表失败", Data: nil})
+			return
+		}
+		sort = models.PhotoSort{Field: cursor.Sort, Asc: cursor.Asc}
+		// 另一个方向上是否有照片：从本次返回的离游标最近的照片开始反向查询，游标位置的照片可能已经被删除
+		var back bool
+		if len(photos) > 0 {
+			edge := sort.Cursor(photos[0], true)
+			if cursor.Prev {
+				edge = sort.Cursor(photos[len(photos)-1], false)
+			}
+			back, err = models.HasPhotosByCursor(currentUser(c).ID, filter, edge)
+			if err != nil {
+				helpers.AppLogger.Errorf("查询照片列表失败: %v", err)
+				c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询照片列表失败", Data: nil})
+				return
+			}
+		}
+		if cursor.Prev {
+			hasNext, hasPrev = back, more
+		} else {
+			hasNext, hasPrev = more, back
+		}
+	} else {
+		helpers.AppLogger.Infof("查询照片列表: 页码 %d, 每页 %d", req.Page, req.PageSize)
+		total, photos, err = models.ListPhotos(currentUser(c).ID, filter, sort, req.Page, req.PageSize)
+		if err != nil {
+			helpers.AppLogger.Errorf("查询照片列表失败: %v", err)
+			c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询照片列表失败", Data: nil})
+			return
+		}
+		hasNext = int64(req.Page*req.PageSize) < total
+		hasPrev = req.Page > 1
+	}
+	var nextCursor, prevCursor string
+	if len(photos) > 0 {
+		if hasNext {
+			nextCursor = sort.Cursor(photos[len(photos)-1], false).Encode()
+		}
+		if hasPrev {
+			prevCursor = sort.Cursor(photos[0], true).Encode()
+		}
+	}
 	helpers.AppLogger.Infof("查询照片列表成功: 总%d张， 本次返回 %d 张", total, len(photos))
-	c.JSON(http.StatusOK, APIResponse[map[string]any]{Code: Success, Message: "", Data: map[string]any{"total": total, "photos": photos}})
+	c.JSON(http.StatusOK, APIResponse[map[string]any]{Code: Success, Message: "", Data: map[string]any{"total": total, "photos": photos, "next_cursor": nextCursor, "prev_cursor": prevCursor}})
 }
 
 type PhotoUpdateRequest struct {
@@ -204,7 +353,14 @@ func HandlePhotoUpdate(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
 		return
 	}
-	photo, err := models.GetPhotoByPath(req.Path)
+	user := currentUser(c)
+	// 与上传时一样清理路径，照片记录中保存的是清理后的相对路径
+	path, _, err := user.ResolvePath(req.Path)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	photo, err := models.GetPhotoByPath(user.ID, path)
 	if err != nil {
 		helpers.AppLogger.Errorf("查询照片失败: %v", err)
 		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询照片失败: " + err.Error(), Data: nil})
@@ -233,5 +389,6 @@ func HandlePhotoUpdate(c *gin.Context) {
 	// 		return
 	// 	}
 	// }
+	audit(c, models.AuditPhotoUpdate, path, "fileUri="+req.FileUri)
 	c.JSON(http.StatusOK, APIResponse[any]{Code: Success, Message: "更新成功", Data: req.Path})
 }
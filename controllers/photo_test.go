@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+)
+
+func TestPhotoUpdateResolvesPath(t *testing.T) {
+	user, err := models.CreateUser("photoupdate", "password", models.RoleMember, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo := models.Photo{UserId: user.ID, Name: "b.jpg", Path: filepath.Join("a", "b.jpg"), Type: models.PhotoTypeNormal, Checksum: "photoupdate"}
+	if err := helpers.Db.Create(&photo).Error; err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/photo/update", func(c *gin.Context) { c.Set("user", user) }, HandlePhotoUpdate)
+	cases := []struct {
+		path   string
+		status int
+		code   APIResponseCode
+	}{
+		{"a/b.jpg", http.StatusOK, Success},
+		{"/a/b.jpg", http.StatusOK, Success},
+		{"a/../a/b.jpg", http.StatusOK, Success},
+		{"a/./b.jpg", http.StatusOK, Success},
+		{`a\b.jpg`, http.StatusOK, Success},
+		{"../photoupdate/a/b.jpg", http.StatusBadRequest, BadRequest},
+	}
+	for _, c := range cases {
+		body, _ := json.Marshal(map[string]string{"path": c.path, "fileUri": "file://" + c.path})
+		req := httptest.NewRequest(http.MethodPost, "/photo/update", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp APIResponse[any]
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != c.status || resp.Code != c.code {
+			t.Errorf("%s: status = %d code = %d, want %d %d: %s", c.path, w.Code, resp.Code, c.status, c.code, w.Body.String())
+			continue
+		}
+		if c.code == Success {
+			updated, err := models.GetPhotoById(photo.ID)
+			if err != nil || updated.FileURI != "file://"+c.path {
+				t.Errorf("%s: fileUri = %q, err = %v", c.path, updated.FileURI, err)
+			}
+		}
+	}
+}
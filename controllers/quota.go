@@ -0,0 +1,21 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+)
+
+// 查询存储空间的使用情况和配额
+// return: data.used 已使用，data.limit 配额，data.available 剩余可用（-1表示不限制），单位字节
+func HandleQuota(c *gin.Context) {
+	usage, err := models.GetQuotaUsage(currentUser(c).ID)
+	if err != nil {
+		helpers.AppLogger.Errorf("查询存储空间失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询存储空间失败", Data: nil})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse[*models.QuotaUsage]{Code: Success, Message: "", Data: usage})
+}
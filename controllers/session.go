@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+	"gorm.io/gorm"
+)
+
+type DeviceSessionItem struct {
+	*models.DeviceSession
+	Current bool `json:"current"` // 是否为当前请求使用的会话
+}
+
+type RevokeAllSessionsRequest struct {
+	KeepCurrent bool `json:"keepCurrent" form:"keepCurrent"` // 是否保留当前设备
+}
+
+// 当前用户的登录设备列表
+func HandleSessionList(c *gin.Context) {
+	sessions, err := models.ListDeviceSessions(currentUser(c).ID)
+	if err != nil {
+		helpers.AppLogger.Errorf("查询登录设备失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询登录设备失败", Data: nil})
+		return
+	}
+	current := currentSession(c)
+	items := make([]DeviceSessionItem, 0, len(sessions))
+	for _, s := range sessions {
+		items = append(items, DeviceSessionItem{DeviceSession: s, Current: s.ID == current.ID})
+	}
+	c.JSON(http.StatusOK, APIResponse[[]DeviceSessionItem]{Code: Success, Message: "", Data: items})
+}
+
+// 撤销一个登录设备，该设备的Token立即失效
+func HandleSessionRevoke(c *gin.Context) {
+	var req UserIdRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	if err := models.RevokeDeviceSession(user.ID, req.ID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "登录设备不存在", Data: nil})
+			return
+		}
+		helpers.AppLogger.Errorf("撤销登录设备失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "撤销登录设备失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AppLogger.Infof("%s 撤销了登录设备 %d", user.Username, req.ID)
+	audit(c, models.AuditSessionRevoke, strconv.FormatUint(uint64(req.ID), 10), "")
+	c.JSON(http.StatusOK, APIResponse[any]{Code: Success, Message: "撤销成功", Data: nil})
+}
+
+// 撤销当前用户的所有登录设备
+func HandleSessionRevokeAll(c *gin.Context) {
+	var req RevokeAllSessionsRequest
+	// 所有参数都是可选的，允许不带请求体
+	if err := c.ShouldBind(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	var keepSession uint
+	if req.KeepCurrent {
+		keepSession = currentSession(c).ID
+	}
+	if err := models.RevokeUserSessions(user.ID, keepSession); err != nil {
+		helpers.AppLogger.Errorf("撤销登录设备失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "撤销登录设备失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AppLogger.Infof("%s 撤销了所有登录设备，保留当前设备: %v", user.Username, req.KeepCurrent)
+	audit(c, models.AuditSessionRevoke, "all", fmt.Sprintf("keepCurrent=%v", req.KeepCurrent))
+	c.JSON(http.StatusOK, APIResponse[any]{Code: Success, Message: "撤销成功", Data: nil})
+}
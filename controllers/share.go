@@ -0,0 +1,305 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+	"gorm.io/gorm"
+)
+
+type CreateShareLinkRequest struct {
+	Name      string `json:"name" form:"name"`
+	PhotoIds  []uint `json:"photoIds" form:"photoIds" binding:"required"` // 分享的照片ID，可以是一张或者多张
+	Password  string `json:"password" form:"password"`                    // 访问密码，为空表示不需要密码
+	ExpiresIn int64  `json:"expiresIn" form:"expiresIn"`                  // 有效期，单位秒，0表示永不过期
+}
+
+type ShareLinkItem struct {
+	*models.ShareLink
+	HasPassword bool `json:"has_password"` // 是否设置了访问密码
+}
+
+// 分享页面中展示的照片信息，不包含路径、fileUri等隐私信息
+type SharePhotoItem struct {
+	ID    uint             `json:"id"`
+	Name  string           `json:"name"`
+	Size  int64            `json:"size"`
+	Type  models.PhotoType `json:"type"`
+	MTime int64            `json:"mtime"`
+	Live  bool             `json:"live"` // 是否为动态照片，可以用live=1下载视频部分
+}
+
+type ShareInfoResponse struct {
+	Name      string           `json:"name"`
+	ExpiresAt int64            `json:"expires_at"`
+	Photos    []SharePhotoItem `json:"photos"`
+}
+
+// 创建分享链接
+func HandleShareCreate(c *gin.Context) {
+	var req CreateShareLinkRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	var expiresAt int64
+	if req.ExpiresIn > 0 {
+		expiresAt = time.Now().Unix() + req.ExpiresIn
+	}
+	share, err := models.CreateShareLink(user.ID, req.Name, req.PhotoIds, req.Password, expiresAt)
+	if err != nil {
+		helpers.AppLogger.Errorf("创建分享链接失败: %v", err)
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "创建分享链接失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AppLogger.Infof("用户 %s 创建了分享链接 %d，照片: %s", user.Username, share.ID, share.PhotoIds)
+	audit(c, models.AuditShareCreate, strconv.FormatUint(uint64(share.ID), 10), "photos="+share.PhotoIds)
+	c.JSON(http.StatusOK, APIResponse[ShareLinkItem]{Code: Success, Message: "", Data: ShareLinkItem{ShareLink: share, HasPassword: share.HasPassword()}})
+}
+
+// 当前用户的分享链接列表，包含访问次数
+func HandleShareList(c *gin.Context) {
+	shares, err := models.ListShareLinks(currentUser(c).ID)
+	if err != nil {
+		helpers.AppLogger.Errorf("查询分享链接失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询分享链接失败", Data: nil})
+		return
+	}
+	items := make([]ShareLinkItem, 0, len(shares))
+	for _, s := range shares {
+		items = append(items, ShareLinkItem{ShareLink: s, HasPassword: s.HasPassword()})
+	}
+	c.JSON(http.StatusOK, APIResponse[[]ShareLinkItem]{Code: Success, Message: "", Data: items})
+}
+
+// 撤销分享链接，撤销后立即失效
+func HandleShareRevoke(c *gin.Context) {
+	var req UserIdRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	if err := models.RevokeShareLink(user.ID, req.ID); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "分享链接不存在", Data: nil})
+			return
+		}
+		helpers.AppLogger.Errorf("撤销分享链接失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "撤销分享链接失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AppLogger.Infof("用户 %s 撤销了分享链接 %d", user.Username, req.ID)
+	audit(c, models.AuditShareRevoke, strconv.FormatUint(uint64(req.ID), 10), "")
+	c.JSON(http.StatusOK, APIResponse[any]{Code: Success, Message: "撤销成功", Data: nil})
+}
+
+// 查看分享的内容，不需要登录
+// http://yourserver/s/:token，有密码的分享需要先调用/s/:token/unlock
+func HandleShareView(c *gin.Context) {
+	share, _, ok := openShareLink(c)
+	if !ok {
+		return
+	}
+	photos, err := share.Photos()
+	if err != nil {
+		helpers.AppLogger.Errorf("查询分享的照片失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询分享的照片失败", Data: nil})
+		return
+	}
+	share.AddView()
+	items := make([]SharePhotoItem, 0, len(photos))
+	for _, p := range photos {
+		items = append(items, SharePhotoItem{ID: p.ID, Name: p.Name, Size: p.Size, Type: p.Type, MTime: p.MTime, Live: p.LivePhotoVideoPath != ""})
+	}
+	c.JSON(http.StatusOK, APIResponse[ShareInfoResponse]{Code: Success, Message: "", Data: ShareInfoResponse{Name: share.Name, ExpiresAt: share.ExpiresAt, Photos: items}})
+}
+
+// 分享中照片的缩略图，不需要登录
+// http://yourserver/s/:token/thumbnail/:id/100x100
+func HandleShareThumbnail(c *gin.Context) {
+	_, _, photo, ok := openSharePhoto(c)
+	if !ok {
+		return
+	}
+	serveThumbnail(c, photo.LibraryPath(), c.Param("size"))
+}
+
+// 下载分享中的照片原图，动态照片使用live=1下载视频部分，不需要登录
+// http://yourserver/s/:token/download/:id?live=1
+func HandleShareDownload(c *gin.Context) {
+	share, owner, photo, ok := openSharePhoto(c)
+	if !ok {
+		return
+	}
+	path := photo.Path
+	if c.Query("live") == "1" && photo.LivePhotoVideoPath != "" {
+		path = photo.LivePhotoVideoPath
+	}
+	share.AddView()
+	downloadPhoto(c, owner, DownloadQuery{Path: path})
+}
+
+// 打开分享链接中的一张照片
+func openSharePhoto(c *gin.Context) (*models.ShareLink, *models.User, *models.Photo, bool) {
+	share, owner, ok := openShareLink(c)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || !share.Contains(uint(id)) {
+		c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "照片未找到", Data: nil})
+		return nil, nil, nil, false
+	}
+	photo, err := models.GetPhotoById(uint(id))
+	if err != nil || photo.UserId != share.UserId {
+		c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "照片未找到", Data: nil})
+		return nil, nil, nil, false
+	}
+	return share, owner, photo, true
+}
+
+// 查询分享链接和分享者，链接无效或者分享者不可用时回复404
+func findShareLink(c *gin.Context) (*models.ShareLink, *models.User, bool) {
+	share, err := models.GetShareLinkByToken(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: models.ErrShareLinkInvalid.Error(), Data: nil})
+		return nil, nil, false
+	}
+	owner, err := activeUser(share.UserId)
+	if err != nil {
+		c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: models.ErrShareLinkInvalid.Error(), Data: nil})
+		return nil, nil, false
+	}
+	return share, owner, true
+}
+
+// 校验分享链接：是否有效、分享者是否可用，有密码的分享需要有效的访问凭证
+// 访问凭证由/s/:token/unlock签发，通过X-Share-Access头或者Cookie传递，不再每次校验密码
+func openShareLink(c *gin.Context) (*models.ShareLink, *models.User, bool) {
+	share, owner, ok := findShareLink(c)
+	if !ok {
+		return nil, nil, false
+	}
+	if !share.HasPassword() {
+		return share, owner, true
+	}
+	access := c.GetHeader("X-Share-Access")
+	if access == "" {
+		access, _ = c.Cookie(shareAccessCookie)
+	}
+	if access == "" || validateShareAccess(access, share) != nil {
+		c.JSON(http.StatusUnauthorized, APIResponse[any]{Code: SharePasswordRequired, Message: "请输入访问密码", Data: nil})
+		return nil, nil, false
+	}
+	return share, owner, true
+}
+
+// 分享访问凭证的有效期
+const shareAccessTTL = 2 * time.Hour
+
+// 保存分享访问凭证的Cookie，路径限制在分享链接下
+const shareAccessCookie = "share_access"
+
+// 分享访问凭证的audience，与登录Token区分，两者不能互相使用
+const shareAccessAudience = "share"
+
+// 输入访问密码后签发的分享访问凭证，Subject为分享链接的token
+type ShareAccessClaims struct {
+	ShareId uint `json:"share_id"`
+	jwt.RegisteredClaims
+}
+
+func signShareAccess(share *models.ShareLink) (string, error) {
+	now := time.Now()
+	claims := &ShareAccessClaims{
+		ShareId: share.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   share.Token,
+			Audience:  jwt.ClaimStrings{shareAccessAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(shareAccessTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(helpers.JwtSecret)
+}
+
+func validateShareAccess(tokenString string, share *models.ShareLink) error {
+	var claims ShareAccessClaims
+	token, err := jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		return helpers.JwtSecret, nil
+	}, jwt.WithAudience(shareAccessAudience), jwt.WithSubject(share.Token), jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !token.Valid {
+		return fmt.Errorf("分享访问凭证校验失败: %v", err)
+	}
+	if claims.ShareId != share.ID {
+		return fmt.Errorf("分享访问凭证与分享链接不一致")
+	}
+	return nil
+}
+
+type ShareUnlockRequest struct {
+	Password string `json:"password" form:"password"`
+}
+
+type ShareUnlockResponse struct {
+	AccessToken string `json:"accessToken"` // 访问凭证，通过X-Share-Access头传递，同时也会写入Cookie
+	ExpiresIn   int64  `json:"expiresIn"`   // 有效期，单位秒
+}
+
+// 使用访问密码换取分享访问凭证，不需要登录
+// 密码通过POST请求体的password字段或者X-Share-Password头传递，不能放在URL中以免被写入访问日志
+// 密码错误次数过多时和登录一样被限制
+func HandleShareUnlock(c *gin.Context) {
+	share, _, ok := findShareLink(c)
+	if !ok {
+		return
+	}
+	if !share.HasPassword() {
+		c.JSON(http.StatusOK, APIResponse[ShareUnlockResponse]{Code: Success, Message: "", Data: ShareUnlockResponse{}})
+		return
+	}
+	var req ShareUnlockRequest
+	_ = c.ShouldBind(&req)
+	password := req.Password
+	if password == "" {
+		password = c.GetHeader("X-Share-Password")
+	}
+	if password == "" {
+		c.JSON(http.StatusUnauthorized, APIResponse[any]{Code: SharePasswordRequired, Message: "请输入访问密码", Data: nil})
+		return
+	}
+	ip := c.ClientIP()
+	// 分享的限制键不会和用户名冲突，用户名中不允许出现冒号
+	limitKey := "share:" + share.Token
+	if wait := reserveLoginAttempt(ip, limitKey); wait > 0 {
+		retryAfter := int64(wait.Seconds()) + 1
+		c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+		c.JSON(http.StatusTooManyRequests, APIResponse[map[string]int64]{Code: TooManyAttempts, Message: fmt.Sprintf("密码错误次数过多，请%d秒后重试", retryAfter), Data: map[string]int64{"retryAfter": retryAfter}})
+		return
+	}
+	if !share.CheckPassword(password) {
+		helpers.AuthLogger.Warnf("分享链接 %d 访问密码错误, IP %s", share.ID, ip)
+		c.JSON(http.StatusUnauthorized, APIResponse[any]{Code: SharePasswordRequired, Message: "访问密码错误", Data: nil})
+		return
+	}
+	releaseLoginAttempt(ip, limitKey)
+	access, err := signShareAccess(share)
+	if err != nil {
+		helpers.AppLogger.Errorf("签发分享访问凭证失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "签发访问凭证失败", Data: nil})
+		return
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(shareAccessCookie, access, int(shareAccessTTL.Seconds()), "/s/"+share.Token, "", c.Request.TLS != nil, true)
+	c.JSON(http.StatusOK, APIResponse[ShareUnlockResponse]{Code: Success, Message: "", Data: ShareUnlockResponse{AccessToken: access, ExpiresIn: int64(shareAccessTTL.Seconds())}})
+}
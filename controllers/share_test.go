@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+)
+
+func TestShareAccessToken(t *testing.T) {
+	helpers.JwtSecret = []byte("test-secret")
+	share := &models.ShareLink{BaseModel: models.BaseModel{ID: 1}, Token: "abc"}
+	other := &models.ShareLink{BaseModel: models.BaseModel{ID: 2}, Token: "def"}
+	access, err := signShareAccess(share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateShareAccess(access, share); err != nil {
+		t.Errorf("valid access token rejected: %v", err)
+	}
+	if err := validateShareAccess(access, other); err == nil {
+		t.Error("access token accepted for another share")
+	}
+	// 分享访问凭证不能当作登录Token使用
+	if _, err := ValidateJWT(access); err == nil {
+		t.Error("share access token accepted as login token")
+	}
+	// 登录Token也不能当作分享访问凭证使用
+	login, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &LoginUser{ID: 1, Username: "admin", RegisteredClaims: jwt.RegisteredClaims{Subject: "abc", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}}).SignedString(helpers.JwtSecret)
+	if err := validateShareAccess(login, share); err == nil {
+		t.Error("login token accepted as share access token")
+	}
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, &ShareAccessClaims{ShareId: 1, RegisteredClaims: jwt.RegisteredClaims{Subject: "abc", Audience: jwt.ClaimStrings{shareAccessAudience}, ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}}).SignedString(helpers.JwtSecret)
+	if err := validateShareAccess(expired, share); err == nil {
+		t.Error("expired access token accepted")
+	}
+}
@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+)
+
+type TotpEnrollResponse struct {
+	Secret string `json:"secret"` // base32编码的密钥，无法扫码时手动输入
+	URI    string `json:"uri"`    // otpauth URI，客户端生成二维码给验证器APP扫描
+}
+
+type TotpCodeRequest struct {
+	Code string `json:"code" form:"code" binding:"required"` // 验证器APP中的6位验证码
+}
+
+type TotpDisableRequest struct {
+	Password string `json:"password" form:"password" binding:"required"`
+	Code     string `json:"code" form:"code" binding:"required"` // 验证码或者恢复码
+}
+
+// 开通两步验证：生成密钥并返回otpauth URI，需要调用/2fa/confirm确认后才会启用
+func HandleTotpEnroll(c *gin.Context) {
+	user := currentUser(c)
+	if user.TotpEnabled {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "已启用两步验证，如需更换请先关闭", Data: nil})
+		return
+	}
+	if err := user.BeginTOTP(); err != nil {
+		helpers.AppLogger.Errorf("生成用户 %s 的两步验证密钥失败: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "生成密钥失败: " + err.Error(), Data: nil})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse[TotpEnrollResponse]{Code: Success, Message: "", Data: TotpEnrollResponse{Secret: user.TotpSecret, URI: helpers.TOTPURI(models.TotpIssuer, user.Username, user.TotpSecret)}})
+}
+
+// 使用验证码确认并启用两步验证，返回恢复码，恢复码只显示这一次
+func HandleTotpConfirm(c *gin.Context) {
+	var req TotpCodeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	if user.TotpEnabled || user.TotpSecret == "" {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "请先调用/2fa/enroll生成密钥", Data: nil})
+		return
+	}
+	if !user.VerifyTOTP(req.Code) {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "验证码错误", Data: nil})
+		return
+	}
+	codes, err := user.EnableTOTP()
+	if err != nil {
+		helpers.AppLogger.Errorf("启用用户 %s 的两步验证失败: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "启用两步验证失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AuthLogger.Infof("用户 %s 启用了两步验证, IP %s", user.Username, c.ClientIP())
+	audit(c, models.AuditTotpEnable, user.Username, "")
+	c.JSON(http.StatusOK, APIResponse[map[string][]string]{Code: Success, Message: "", Data: map[string][]string{"recoveryCodes": codes}})
+}
+
+// 关闭两步验证，需要密码和验证码（或恢复码）
+func HandleTotpDisable(c *gin.Context) {
+	var req TotpDisableRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	if !user.TotpEnabled {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "没有启用两步验证", Data: nil})
+		return
+	}
+	// 与登录一样限制尝试次数，避免被盗用的Token在线暴力猜测验证码，限制键不会和用户名冲突，用户名中不允许出现冒号
+	ip := c.ClientIP()
+	limitKey := fmt.Sprintf("totp:%d", user.ID)
+	if wait := reserveLoginAttempt(ip, limitKey); wait > 0 {
+		retryAfter := int64(wait.Seconds()) + 1
+		helpers.AuthLogger.Warnf("用户 %s 关闭两步验证被限制, IP %s, %d秒后重试", user.Username, ip, retryAfter)
+		c.Header("Retry-After", strconv.FormatInt(retryAfter, 10))
+		c.JSON(http.StatusTooManyRequests, APIResponse[map[string]int64]{Code: TooManyAttempts, Message: fmt.Sprintf("验证失败次数过多，请%d秒后重试", retryAfter), Data: map[string]int64{"retryAfter": retryAfter}})
+		return
+	}
+	if !user.CheckPassword(req.Password) || !user.VerifySecondFactor(req.Code) {
+		helpers.AuthLogger.Warnf("用户 %s 关闭两步验证失败，密码或验证码错误, IP %s", user.Username, ip)
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "密码或验证码错误", Data: nil})
+		return
+	}
+	recordLoginSuccess(ip, limitKey)
+	if err := user.DisableTOTP(); err != nil {
+		helpers.AppLogger.Errorf("关闭用户 %s 的两步验证失败: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "关闭两步验证失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AuthLogger.Infof("用户 %s 关闭了两步验证, IP %s", user.Username, c.ClientIP())
+	audit(c, models.AuditTotpDisable, user.Username, "")
+	c.JSON(http.StatusOK, APIResponse[any]{Code: Success, Message: "已关闭两步验证", Data: nil})
+}
+
+// 重新生成恢复码，之前的恢复码全部失效
+func HandleTotpRecoveryCodes(c *gin.Context) {
+	var req TotpCodeRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user := currentUser(c)
+	if !user.TotpEnabled {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "没有启用两步验证", Data: nil})
+		return
+	}
+	if !user.VerifyTOTP(req.Code) {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "验证码错误", Data: nil})
+		return
+	}
+	codes, err := models.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		helpers.AppLogger.Errorf("生成用户 %s 的恢复码失败: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "生成恢复码失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AuthLogger.Infof("用户 %s 重新生成了恢复码, IP %s", user.Username, c.ClientIP())
+	c.JSON(http.StatusOK, APIResponse[map[string][]string]{Code: Success, Message: "", Data: map[string][]string{"recoveryCodes": codes}})
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/models"
+)
+
+func TestTotpDisableThrottled(t *testing.T) {
+	resetLoginAttempts(t)
+	user, err := models.CreateUser("totpdisable", "password", models.RoleMember, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.BeginTOTP(); err != nil {
+		t.Fatal(err)
+	}
+	user.TotpEnabled = true
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/2fa/disable", func(c *gin.Context) { c.Set("user", user) }, HandleTotpDisable)
+	disable := func(password string) (int, APIResponseCode) {
+		body, _ := json.Marshal(map[string]string{"password": password, "code": "000000"})
+		req := httptest.NewRequest(http.MethodPost, "/2fa/disable", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var resp APIResponse[any]
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp.Code
+	}
+	// 每次失败都计入该用户的关闭两步验证次数
+	for i := 0; i < usernameLoginLimit.freeFailures; i++ {
+		if status, code := disable("wrong"); status != http.StatusOK || code != BadRequest {
+			t.Fatalf("attempt %d: status = %d code = %d, want %d %d", i+1, status, code, http.StatusOK, BadRequest)
+		}
+	}
+	key := usernameAttemptKey(fmt.Sprintf("totp:%d", user.ID))
+	if got := loginFailures(key); got != usernameLoginLimit.freeFailures {
+		t.Fatalf("failures = %d, want %d", got, usernameLoginLimit.freeFailures)
+	}
+	// 需要等待时直接拒绝，不再校验密码和验证码
+	loginAttemptsLock.Lock()
+	loginAttempts[key].nextAllowed = time.Now().Add(time.Minute)
+	loginAttemptsLock.Unlock()
+	if status, code := disable("password"); status != http.StatusTooManyRequests || code != TooManyAttempts {
+		t.Errorf("throttled attempt: status = %d code = %d, want %d %d", status, code, http.StatusTooManyRequests, TooManyAttempts)
+	}
+}
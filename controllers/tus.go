@@ -0,0 +1,240 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+)
+
+// 基于HTTP的断点续传上传，兼容tus协议 1.0.0（https://tus.io/protocols/resumable-upload）
+// 支持 creation 和 termination 扩展，上传完成后的处理与WebSocket上传一致
+//
+// Upload-Metadata 支持的字段（值为base64编码）：
+//   - path: 相对路径，包含文件名：2025/8/25/a.jpg，没有时使用filename
+//   - filename: 文件名
+//   - type: 照片类型，1-普通照片，2-视频， 3-动态照片
+//   - mtime / ctime: Unix时间戳，单位秒
+//   - fileUri: 鸿蒙系统的照片资源的URI
+//   - checksum: 照片的sha1，上传完成后会与服务器计算的值比对
+//   - live_photo_video_path: 动态照片的视频路径
+const tusVersion = "1.0.0"
+
+// tus协议中checksum不一致时的状态码
+const tusStatusChecksumMismatch = 460
+
+// PATCH请求超过该时间没有收到数据时中断，释放上传的写入锁，客户端HEAD查询偏移量后可以继续
+const tusReadIdleTimeout = time.Minute
+
+// 每次读取前延长连接的读取超时，数据持续到达时不会中断，卡住的请求不会一直占用上传
+type idleTimeoutReader struct {
+	r  io.Reader
+	rc *http.ResponseController
+}
+
+func (r *idleTimeoutReader) Read(p []byte) (int, error) {
+	_ = r.rc.SetReadDeadline(time.Now().Add(tusReadIdleTimeout))
+	return r.r.Read(p)
+}
+
+// 设置tus协议的公共响应头，并检查客户端的协议版本
+func tusPrepare(c *gin.Context) bool {
+	c.Header("Tus-Resumable", tusVersion)
+	if v := c.GetHeader("Tus-Resumable"); v != "" && v != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.JSON(http.StatusPreconditionFailed, APIResponse[any]{Code: BadRequest, Message: "不支持的tus协议版本: " + v, Data: nil})
+		return false
+	}
+	return true
+}
+
+// 解析Upload-Metadata头：以逗号分隔的 "key base64(value)" 列表
+func parseTusMetadata(header string) (map[string]string, error) {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, encoded, _ := strings.Cut(pair, " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("元数据 %s 解码失败: %v", key, err)
+		}
+		meta[key] = string(value)
+	}
+	return meta, nil
+}
+
+// 查询服务器支持的tus协议版本和扩展
+func HandleTusOptions(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", "creation,termination")
+	c.Status(http.StatusNoContent)
+}
+
+// 创建上传，返回Location头，客户端之后向该地址PATCH数据
+// 相同路径和checksum的上传会话已存在时返回已有的会话，客户端HEAD后可以继续上传
+func HandleTusCreate(c *gin.Context) {
+	if !tusPrepare(c) {
+		return
+	}
+	size, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || size <= 0 {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "Upload-Length错误", Data: nil})
+		return
+	}
+	meta, err := parseTusMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	fileName := meta["path"]
+	if fileName == "" {
+		fileName = meta["filename"]
+	}
+	if fileName == "" {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "Upload-Metadata中缺少path或filename", Data: nil})
+		return
+	}
+	photoType, _ := strconv.Atoi(meta["type"])
+	mtime, _ := strconv.ParseInt(meta["mtime"], 10, 64)
+	ctime, _ := strconv.ParseInt(meta["ctime"], 10, 64)
+	chunk := FileChunk{
+		FileName:           fileName,
+		Type:               models.PhotoType(photoType),
+		LivePhotoVideoPath: meta["live_photo_video_path"],
+		MTime:              mtime,
+		CTime:              ctime,
+		FileURI:            meta["fileUri"],
+		Size:               size,
+		Checksum:           meta["checksum"],
+	}
+	if chunk.Type == 0 {
+		chunk.Type = models.PhotoTypeNormal
+	}
+	user := currentUser(c)
+	if err := resolveChunkPath(user, &chunk); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		return
+	}
+	session, err := reserveUploadSession(user, &chunk, requestActor(c))
+	if err != nil {
+		helpers.AppLogger.Warnf("文件 %s 无法上传: %v", fileName, err)
+		if errors.Is(err, models.ErrQuotaExceeded) {
+			c.JSON(http.StatusRequestEntityTooLarge, APIResponse[any]{Code: QuotaExceeded, Message: err.Error(), Data: nil})
+		} else {
+			c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: err.Error(), Data: nil})
+		}
+		return
+	}
+	helpers.AppLogger.Infof("创建HTTP上传: %s => %s, 大小: %d", session.ID, fileName, size)
+	c.Header("Location", "/files/"+session.ID)
+	c.Status(http.StatusCreated)
+}
+
+// 查询上传的偏移量
+func HandleTusHead(c *gin.Context) {
+	if !tusPrepare(c) {
+		return
+	}
+	c.Header("Cache-Control", "no-store")
+	session := findUploadSessionById(currentUser(c).ID, c.Param("id"))
+	if session == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	// 不等待正在进行的PATCH，客户端在上传卡住后可以查询偏移量并继续
+	offset, _, _ := session.progress()
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	c.Header("Upload-Length", strconv.FormatInt(session.Size, 10))
+	c.Status(http.StatusOK)
+}
+
+// 从Upload-Offset开始追加数据，所有数据收到后执行与WebSocket上传相同的处理流程
+func HandleTusPatch(c *gin.Context) {
+	if !tusPrepare(c) {
+		return
+	}
+	if c.ContentType() != "application/offset+octet-stream" {
+		c.JSON(http.StatusUnsupportedMediaType, APIResponse[any]{Code: BadRequest, Message: "Content-Type必须是application/offset+octet-stream", Data: nil})
+		return
+	}
+	session := findUploadSessionById(currentUser(c).ID, c.Param("id"))
+	if session == nil {
+		c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "上传不存在或已过期", Data: nil})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "Upload-Offset错误", Data: nil})
+		return
+	}
+	// 同一个上传同时只能有一个PATCH写入，正在写入时返回423，客户端稍后HEAD查询偏移量再继续
+	if !session.mu.TryLock() {
+		current, _, _ := session.progress()
+		c.Header("Upload-Offset", strconv.FormatInt(current, 10))
+		c.JSON(http.StatusLocked, APIResponse[any]{Code: BadRequest, Message: "该文件正在上传中", Data: nil})
+		return
+	}
+	defer session.mu.Unlock()
+	// 每次请求结束都关闭文件句柄，下次PATCH时重新打开
+	defer session.Close()
+	if offset != session.Offset {
+		c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		c.JSON(http.StatusConflict, APIResponse[any]{Code: BadRequest, Message: fmt.Sprintf("Upload-Offset不一致，服务器已收到 %d 字节", session.Offset), Data: nil})
+		return
+	}
+	rc := http.NewResponseController(c.Writer)
+	defer rc.SetReadDeadline(time.Time{})
+	body := &idleTimeoutReader{r: http.MaxBytesReader(c.Writer, c.Request.Body, session.Size-session.Offset), rc: rc}
+	if _, err := session.ReadFrom(body); err != nil {
+		helpers.AppLogger.Errorf("HTTP上传 %s 写入中断: %v", session.ID, err)
+		c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: fmt.Sprintf("写入失败: %s", err.Error()), Data: nil})
+		return
+	}
+	c.Header("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	if !session.Complete() {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	removeUploadSession(session)
+	resp := completeUpload(session, &session.meta)
+	switch resp.Code {
+	case Success:
+		c.Status(http.StatusNoContent)
+	case ChecksumMismatch:
+		c.JSON(tusStatusChecksumMismatch, resp)
+	default:
+		c.JSON(http.StatusInternalServerError, resp)
+	}
+}
+
+// 终止上传，删除已上传的临时文件
+func HandleTusDelete(c *gin.Context) {
+	if !tusPrepare(c) {
+		return
+	}
+	session := findUploadSessionById(currentUser(c).ID, c.Param("id"))
+	if session == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	removeUploadSession(session)
+	session.Discard()
+	recordUploadFinished(session, UploadOutcomeFailed, "上传被终止")
+	helpers.AppLogger.Infof("终止HTTP上传: %s => %s", session.ID, session.FileName)
+	c.Status(http.StatusNoContent)
+}
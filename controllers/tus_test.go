@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/models"
+)
+
+// 使用指定用户调用tus接口
+func tusRouter(user *models.User) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set("user", user) })
+	r.HEAD("/files/:id", HandleTusHead)
+	r.PATCH("/files/:id", HandleTusPatch)
+	return r
+}
+
+func TestTusHeadDuringPatch(t *testing.T) {
+	resetUploadSessions(t)
+	user, err := models.CreateUser("tushead", "password", models.RoleMember, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := reserveUploadSession(user, &FileChunk{FileName: "video.mp4", Checksum: "x", Size: 10}, auditActor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := tusRouter(user)
+	// PATCH的请求体只发送一部分后卡住
+	pr, pw := io.Pipe()
+	patchDone := make(chan struct{})
+	go func() {
+		defer close(patchDone)
+		req := httptest.NewRequest(http.MethodPatch, "/files/"+session.ID, pr)
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", "0")
+		r.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	if _, err := pw.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if offset, _, _ := session.progress(); offset == 5 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// HEAD不等待正在进行的PATCH
+	headDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/files/"+session.ID, nil))
+		headDone <- w
+	}()
+	select {
+	case w := <-headDone:
+		if got := w.Header().Get("Upload-Offset"); got != "5" {
+			t.Errorf("Upload-Offset = %s, want 5", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HEAD blocked by PATCH")
+	}
+	// 同时的第二个PATCH被拒绝
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPatch, "/files/"+session.ID, nil)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "5")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusLocked || w.Header().Get("Upload-Offset") != strconv.Itoa(5) {
+		t.Errorf("concurrent PATCH: status = %d, Upload-Offset = %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+	// 请求中断后已写入的数据仍然有效
+	pw.CloseWithError(io.ErrUnexpectedEOF)
+	<-patchDone
+	if offset, _, _ := session.progress(); offset != 5 {
+		t.Errorf("offset after interrupted PATCH = %d, want 5", offset)
+	}
+}
+
+func TestCleanupSkipsSessionBeingWritten(t *testing.T) {
+	resetUploadSessions(t)
+	user, err := models.CreateUser("tuscleanup", "password", models.RoleMember, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy, _ := reserveUploadSession(user, &FileChunk{FileName: "busy.mp4", Checksum: "a", Size: 10}, auditActor{})
+	idle, _ := reserveUploadSession(user, &FileChunk{FileName: "idle.mp4", Checksum: "b", Size: 10}, auditActor{})
+	for _, s := range []*UploadSession{busy, idle} {
+		s.UpdatedAt = time.Now().Add(-2 * uploadSessionIdleTimeout)
+	}
+	busy.mu.Lock()
+	done := make(chan struct{})
+	go func() {
+		CleanupExpiredUploadSessions()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cleanup blocked by session being written")
+	}
+	busy.mu.Unlock()
+	if findUploadSessionById(user.ID, busy.ID) == nil {
+		t.Error("session being written was removed")
+	}
+	if findUploadSessionById(user.ID, idle.ID) != nil {
+		t.Error("idle session was not removed")
+	}
+}
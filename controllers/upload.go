@@ -1,11 +1,15 @@
 package controllers
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/qicfan/backup-server/helpers"
@@ -25,7 +29,35 @@ type FileChunk struct {
 	Size               int64            `json:"size"`                  // 照片的大小，单位字节
 	ChunkIndex         int              `json:"chunkIndex"`            // 当前块索引
 	ChunkCount         int              `json:"chunkCount"`            // 总块数
-	Checksum           string           `json:"checksum"`              // 可选，照片的sha1校验和，如果有该字段则上传完成后会检查是否存在相同checksum的照片，如果存在则删除已上传的文件
+	Checksum           string           `json:"checksum"`              // 可选，照片的sha1校验和，服务器会与实际收到数据的sha1比对，不一致则返回ChecksumMismatch
+	Action             string           `json:"action"`                // 可选，为resume时表示查询续传位置，此时没有二进制帧
+	ChunkChecksum      string           `json:"chunkChecksum"`         // 可选，当前分片数据的sha1，不一致时服务器回复ChunkNack
+	Ack                bool             `json:"ack"`                   // 可选，为true时服务器每收到一个分片都回复ChunkAck，最后一个分片仍然回复上传结果
+	UploadId           string           `json:"uploadId"`              // 可选，客户端为每个文件生成的唯一ID，同一个连接上可以交替发送多个文件的分片，服务器的所有回复都会带上该ID
+}
+
+// 一个连接上同时进行的上传数量上限
+const maxConcurrentUploads = 32
+
+// 查询续传位置的动作
+const UploadActionResume = "resume"
+
+// 分片的确认结果，客户端收到ChunkNack后从NextChunkIndex重新发送
+type ChunkResult struct {
+	UploadId       string `json:"uploadId"`
+	FileName       string `json:"fileName"`
+	ChunkIndex     int    `json:"chunkIndex"`     // 本次确认的分片索引
+	NextChunkIndex int    `json:"nextChunkIndex"` // 下一个需要上传的分片索引
+	Offset         int64  `json:"offset"`         // 服务器已收到的字节数
+}
+
+// 续传位置
+type UploadProgress struct {
+	UploadId       string `json:"uploadId"`
+	FileName       string `json:"fileName"`
+	ChunkCount     int    `json:"chunkCount"`
+	NextChunkIndex int    `json:"nextChunkIndex"` // 下一个需要上传的分片索引
+	Offset         int64  `json:"offset"`         // 服务器已收到的字节数
 }
 
 var upgrader = websocket.Upgrader{
@@ -35,17 +67,23 @@ var upgrader = websocket.Upgrader{
 
 func HandleUpload(c *gin.Context) {
 	tokenString := c.GetHeader("Sec-WebSocket-Protocol")
-	helpers.AppLogger.Infof("HandleUpload called with token %s", tokenString)
 	if tokenString == "" {
 		helpers.AppLogger.Error("Missing JWT token")
 		c.String(401, "Missing JWT token")
 		return
 	}
-	if _, err := ValidateJWT(tokenString); err != nil {
+	user, deviceSession, apiKey, err := authenticate(tokenString, c.ClientIP())
+	if err != nil {
 		helpers.AppLogger.Error("Invalid JWT token:", err)
 		c.String(401, "Invalid JWT token: %s", err.Error())
 		return
 	}
+	if err := checkScope(user, apiKey, models.ScopeUpload); err != nil {
+		helpers.AppLogger.Warnf("用户 %s 没有上传权限: %v", user.Username, err)
+		c.String(403, "No upload permission")
+		return
+	}
+	actor := newAuditActor(user, deviceSession, c.ClientIP(), c.Query("cos"))
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		helpers.AppLogger.Error("WebSocket upgrade error:", err)
@@ -55,7 +93,16 @@ func HandleUpload(c *gin.Context) {
 	// 设置300秒超时
 	timeoutSec := 300
 	// conn.WriteMessage(websocket.TextMessage, []byte("hello, welcome connect this ws"))
-	var targetFileFd *os.File
+	// 本连接上正在进行的上传，key为uploadId，客户端可以在一个连接上交替发送多个文件的分片
+	// 连接断开时关闭文件句柄，会话保留以便重连后继续上传
+	uploads := make(map[string]*UploadSession)
+	defer func() {
+		for _, s := range uploads {
+			s.mu.Lock()
+			s.Close()
+			s.mu.Unlock()
+		}
+	}()
 	for {
 		// 设置读取超时时间
 		_ = conn.SetReadDeadline(time.Now().Add(time.Duration(timeoutSec) * time.Second))
@@ -81,6 +128,15 @@ func HandleUpload(c *gin.Context) {
 			helpers.AppLogger.Error("Unmarshal error:", err)
 			continue
 		}
+		if chunk.Action == UploadActionResume {
+			// 查询续传位置，没有二进制帧
+			if err := resolveChunkPath(user, &chunk); err != nil {
+				writeChunkPathError(conn, &chunk, err)
+				continue
+			}
+			writeUploadProgress(conn, user.ID, &chunk)
+			continue
+		}
 		if chunk.ChunkIndex == 0 {
 			helpers.AppLogger.Infof("收到文件传输信息：%d/%d => %s, checksum: %s", chunk.ChunkIndex+1, chunk.ChunkCount, chunk.FileName, chunk.Checksum)
 		}
@@ -101,68 +157,205 @@ func HandleUpload(c *gin.Context) {
 			break
 		}
 		helpers.AppLogger.Debugf("Received binary data for chunk %d/%d => %s", chunk.ChunkIndex+1, chunk.ChunkCount, chunk.FileName)
-		relPath := filepath.Dir(chunk.FileName)
-		fileName := filepath.Base(chunk.FileName)
-		targetPath := filepath.Join(helpers.UPLOAD_ROOT_DIR, relPath)
-		targetFile := filepath.Join(targetPath, fileName)
-		if err := os.MkdirAll(targetPath, 0755); err != nil {
-			helpers.AppLogger.Error("MkdirAll error:", err)
+		if err := resolveChunkPath(user, &chunk); err != nil {
+			writeChunkPathError(conn, &chunk, err)
 			continue
 		}
-		if targetFileFd == nil {
-			targetFileFd, err = os.OpenFile(targetFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		uploadId := chunk.UploadId
+		if uploadId == "" {
+			// 旧版客户端不传uploadId，一次只上传一个文件
+			uploadId = uploadSessionKey(user.ID, chunk.FileName, chunk.Checksum)
+		}
+		session, ok := uploads[uploadId]
+		if !ok || session.FileName != chunk.FileName {
+			if !ok && len(uploads) >= maxConcurrentUploads {
+				helpers.AppLogger.Warnf("连接上同时上传的文件超过 %d 个，拒绝文件 %s", maxConcurrentUploads, chunk.FileName)
+				resp := APIResponse[ChunkResult]{Code: ChunkNack, Message: fmt.Sprintf("同时上传的文件不能超过 %d 个", maxConcurrentUploads), Data: ChunkResult{UploadId: chunk.UploadId, FileName: chunk.FileName, ChunkIndex: chunk.ChunkIndex}}
+				msg, _ := json.Marshal(resp)
+				_ = conn.WriteMessage(websocket.TextMessage, msg)
+				continue
+			}
+			reserved, err := reserveUploadSession(user, &chunk, actor)
 			if err != nil {
-				helpers.AppLogger.Error("Open target file error:", err)
-				resp := APIResponse[any]{Code: BadRequest, Message: fmt.Sprintf("打开目标文件失败: %s", err.Error()), Data: nil}
+				helpers.AppLogger.Warnf("文件 %s 无法上传: %v", chunk.FileName, err)
+				code := BadRequest
+				if errors.Is(err, models.ErrQuotaExceeded) {
+					code = QuotaExceeded
+				}
+				resp := APIResponse[ChunkResult]{Code: code, Message: err.Error(), Data: ChunkResult{UploadId: chunk.UploadId, FileName: chunk.FileName, ChunkIndex: chunk.ChunkIndex}}
 				msg, _ := json.Marshal(resp)
 				_ = conn.WriteMessage(websocket.TextMessage, msg)
 				continue
 			}
+			if ok {
+				// 同一个uploadId换了文件，关闭之前文件的句柄
+				session.mu.Lock()
+				session.Close()
+				session.mu.Unlock()
+			}
+			session = reserved
+			uploads[uploadId] = session
+		}
+		if receiveChunk(conn, session, &chunk, rawData) {
+			delete(uploads, uploadId)
 		}
+	}
+}
 
-		if _, err := targetFileFd.Write(rawData); err != nil {
-			helpers.AppLogger.Error("Chunk写入失败:", err)
-			targetFileFd.Close()
-			targetFileFd = nil
-			continue
+// 处理一个分片：校验分片的sha1和顺序，写入临时文件，并回复ack/nack
+// 所有分片都收到后完成上传并通知客户端结果，返回true
+func receiveChunk(conn *websocket.Conn, session *UploadSession, chunk *FileChunk, rawData []byte) bool {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if chunk.ChunkIndex == 0 && chunk.Checksum == "" && session.NextChunkIndex > 0 {
+		// 没有checksum无法确认是同一个文件，从头开始
+		session.Reset()
+	}
+	if chunk.ChunkIndex < session.NextChunkIndex {
+		// 重连后客户端重发了已经收到的分片，直接丢弃
+		helpers.AppLogger.Debugf("文件 %s 的分片 %d 已经收到，跳过", chunk.FileName, chunk.ChunkIndex)
+		if chunk.Ack {
+			writeChunkResult(conn, ChunkAck, session, chunk, "")
 		}
-		// 检查是否所有chunk都已上传
-		complete := chunk.ChunkCount == chunk.ChunkIndex+1
-		if complete {
-			targetFileFd.Close()
-			targetFileFd = nil
-			helpers.AppLogger.Infof("文件 %s 所有分片上传完成. 开始合并文件并插入数据库", targetFile)
-			// 插入数据库
-			photoType := chunk.Type
-			livePhotoVideoPath := chunk.LivePhotoVideoPath
-			// 计算sha1
-			// checksum, _ := helpers.FileSHA1(targetFile)
-			checksum := chunk.Checksum
-			if checksum == "" {
-				checksum, _ = helpers.FileSHA1(targetFile)
-			}
-			// helpers.AppLogger.Infof("照片哈希值: %s => %s", chunk.FileName, checksum)
-			// 检查是否存在checksum相同的照片
-			if exists, _ := models.CheckPhotoChecksum(checksum); exists {
-				helpers.AppLogger.Infof("Checksum exists:%s => %s", chunk.FileName, checksum)
-				// 删除已上传的文件
-				os.Remove(targetFile)
-			} else {
-				helpers.AppLogger.Infof("Checksum not exists: %s => %s", chunk.FileName, checksum)
-				if err := models.InsertPhoto(fileName, chunk.FileName, chunk.Size, photoType, livePhotoVideoPath, chunk.FileURI, chunk.MTime, chunk.CTime, checksum, 0); err != nil {
-					helpers.AppLogger.Error("照片写入数据库错误:", err)
-				}
-				// 修改文件的ctime和mtime
-				mtime := time.Unix(chunk.MTime, 0)
-				ctime := time.Unix(chunk.CTime, 0)
-				os.Chtimes(targetFile, mtime, ctime)
-			}
-			// 通知客户端上传完成
-			resp := APIResponse[map[string]string]{Code: Success, Message: "上传完成", Data: map[string]string{"path": chunk.FileName}}
-			msg, _ := json.Marshal(resp)
-			helpers.AppLogger.Infof("文件 %s 上传返回数据: %s", targetFile, string(msg))
-			_ = conn.WriteMessage(websocket.TextMessage, msg)
-			helpers.AppLogger.Infof("文件 %s 上传完成.", targetFile)
+		return false
+	}
+	if chunk.ChunkIndex > session.NextChunkIndex {
+		// 乱序或者中间缺少分片，拒绝该分片，客户端需要从缺失的分片继续
+		helpers.AppLogger.Warnf("文件 %s 缺少分片 %d，收到的是分片 %d", chunk.FileName, session.NextChunkIndex, chunk.ChunkIndex)
+		writeChunkResult(conn, ChunkNack, session, chunk, fmt.Sprintf("缺少分片 %d", session.NextChunkIndex))
+		return false
+	}
+	if chunk.ChunkChecksum != "" {
+		sum := sha1.Sum(rawData)
+		if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, chunk.ChunkChecksum) {
+			helpers.AppLogger.Warnf("文件 %s 的分片 %d 校验失败，客户端: %s，服务器: %s", chunk.FileName, chunk.ChunkIndex, chunk.ChunkChecksum, actual)
+			writeChunkResult(conn, ChunkNack, session, chunk, "分片校验失败")
+			return false
+		}
+	}
+	if err := session.Write(rawData); err != nil {
+		helpers.AppLogger.Error("Chunk写入失败:", err)
+		writeChunkResult(conn, ChunkNack, session, chunk, fmt.Sprintf("分片写入失败: %s", err.Error()))
+		return false
+	}
+	// 检查是否所有chunk都已上传
+	if !session.Complete() {
+		if chunk.Ack {
+			writeChunkResult(conn, ChunkAck, session, chunk, "")
+		}
+		return false
+	}
+	removeUploadSession(session)
+	resp := completeUpload(session, chunk)
+	// 通知客户端上传结果
+	msg, _ := json.Marshal(resp)
+	helpers.AppLogger.Infof("文件 %s 上传返回数据: %s", session.targetFile, string(msg))
+	_ = conn.WriteMessage(websocket.TextMessage, msg)
+	return true
+}
+
+// 回复分片的确认结果，调用方需要持有session.mu
+func writeChunkResult(conn *websocket.Conn, code APIResponseCode, session *UploadSession, chunk *FileChunk, reason string) {
+	resp := APIResponse[ChunkResult]{Code: code, Message: reason, Data: ChunkResult{
+		UploadId:       chunk.UploadId,
+		FileName:       chunk.FileName,
+		ChunkIndex:     chunk.ChunkIndex,
+		NextChunkIndex: session.NextChunkIndex,
+		Offset:         session.Offset,
+	}}
+	msg, _ := json.Marshal(resp)
+	_ = conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// 所有分片收到后的处理：校验临时文件，检查checksum是否重复，重命名为最终文件并写入数据库
+// 调用方需要持有session.mu
+func completeUpload(session *UploadSession, chunk *FileChunk) APIResponse[map[string]string] {
+	targetFile := session.targetFile
+	fileName := filepath.Base(chunk.FileName)
+	data := map[string]string{"path": chunk.FileName, "uploadId": chunk.UploadId}
+	helpers.AppLogger.Infof("文件 %s 所有分片上传完成. 开始校验文件并插入数据库", targetFile)
+	if err := session.Seal(); err != nil {
+		helpers.AppLogger.Errorf("文件 %s 校验失败: %v", targetFile, err)
+		recordUploadFinished(session, UploadOutcomeFailed, err.Error())
+		return APIResponse[map[string]string]{Code: BadRequest, Message: fmt.Sprintf("文件校验失败: %s", err.Error()), Data: data}
+	}
+	// 使用服务器根据实际收到的数据计算的sha1，不信任客户端提供的值
+	checksum := session.Sum()
+	if chunk.Checksum != "" && !strings.EqualFold(chunk.Checksum, checksum) {
+		helpers.AppLogger.Errorf("文件 %s checksum不一致，客户端: %s，服务器: %s", chunk.FileName, chunk.Checksum, checksum)
+		data["checksum"] = checksum
+		session.Discard()
+		recordUploadFinished(session, UploadOutcomeFailed, "checksum不一致")
+		return APIResponse[map[string]string]{Code: ChecksumMismatch, Message: "文件校验失败，checksum不一致，请重新上传", Data: data}
+	}
+	// 检查是否存在checksum相同的照片
+	if exists, _ := models.CheckPhotoChecksum(session.UserId, checksum); exists {
+		helpers.AppLogger.Infof("Checksum exists:%s => %s", chunk.FileName, checksum)
+		// 删除已上传的文件
+		session.Discard()
+		recordUploadFinished(session, UploadOutcomeDeduplicated, "")
+		helpers.AppLogger.Infof("文件 %s 上传完成.", targetFile)
+		return APIResponse[map[string]string]{Code: Success, Message: "上传完成", Data: data}
+	}
+	helpers.AppLogger.Infof("Checksum not exists: %s => %s", chunk.FileName, checksum)
+	if err := session.Commit(); err != nil {
+		helpers.AppLogger.Errorf("文件 %s 保存失败: %v", targetFile, err)
+		recordUploadFinished(session, UploadOutcomeFailed, err.Error())
+		return APIResponse[map[string]string]{Code: BadRequest, Message: fmt.Sprintf("文件保存失败: %s", err.Error()), Data: data}
+	}
+	// 修改文件的ctime和mtime
+	mtime := time.Unix(chunk.MTime, 0)
+	ctime := time.Unix(chunk.CTime, 0)
+	os.Chtimes(targetFile, mtime, ctime)
+	// 重命名后再插入数据库
+	preChecksum, _ := helpers.FileHeadSHA1(targetFile)
+	if err := models.InsertPhoto(session.UserId, fileName, chunk.FileName, chunk.Size, chunk.Type, chunk.LivePhotoVideoPath, chunk.FileURI, chunk.MTime, chunk.CTime, checksum, preChecksum, 0); err != nil {
+		helpers.AppLogger.Error("照片写入数据库错误:", err)
+	} else {
+		models.RefreshPhotoMetadataAsync(session.UserId, chunk.FileName)
+	}
+	recordUploadFinished(session, UploadOutcomeStored, "")
+	helpers.AppLogger.Infof("文件 %s 上传完成.", targetFile)
+	return APIResponse[map[string]string]{Code: Success, Message: "上传完成", Data: data}
+}
+
+// 校验并清理客户端提供的文件路径，路径不能位于用户照片目录之外，也不能是目录本身
+func resolveChunkPath(user *models.User, chunk *FileChunk) error {
+	rel, _, err := user.ResolvePath(chunk.FileName)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return fmt.Errorf("文件路径不能为空")
+	}
+	chunk.FileName = rel
+	if chunk.LivePhotoVideoPath != "" {
+		if chunk.LivePhotoVideoPath, _, err = user.ResolvePath(chunk.LivePhotoVideoPath); err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// 回复客户端文件路径不合法
+func writeChunkPathError(conn *websocket.Conn, chunk *FileChunk, err error) {
+	helpers.AppLogger.Warnf("拒绝文件 %s: %v", chunk.FileName, err)
+	resp := APIResponse[ChunkResult]{Code: BadRequest, Message: err.Error(), Data: ChunkResult{UploadId: chunk.UploadId, FileName: chunk.FileName, ChunkIndex: chunk.ChunkIndex}}
+	msg, _ := json.Marshal(resp)
+	_ = conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// 回复客户端文件的续传位置，没有会话则从第一个分片开始
+func writeUploadProgress(conn *websocket.Conn, userId uint, chunk *FileChunk) {
+	progress := UploadProgress{UploadId: chunk.UploadId, FileName: chunk.FileName, ChunkCount: chunk.ChunkCount}
+	message := "从头开始上传"
+	if session := findUploadSession(userId, chunk.FileName, chunk.Checksum); session != nil {
+		progress.ChunkCount = session.ChunkCount
+		progress.Offset, progress.NextChunkIndex, _ = session.progress()
+		message = "继续上传"
+	}
+	helpers.AppLogger.Infof("文件 %s 从分片 %d 继续上传，已收到 %d 字节", chunk.FileName, progress.NextChunkIndex, progress.Offset)
+	resp := APIResponse[UploadProgress]{Code: ContinueTransfer, Message: message, Data: progress}
+	msg, _ := json.Marshal(resp)
+	_ = conn.WriteMessage(websocket.TextMessage, msg)
 }
@@ -0,0 +1,332 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+)
+
+// 上传会话空闲多久后被清理
+const uploadSessionIdleTimeout = 24 * time.Hour
+
+// 上传会话，每个用户的每个文件（路径+checksum）对应一个会话
+// 客户端断线重连后可以通过会话查询已经收到的分片，从缺失的分片继续上传
+type UploadSession struct {
+	ID             string    `json:"id"`
+	Key            string    `json:"-"`
+	UserId         uint      `json:"userId"`         // 上传文件的用户
+	FileName       string    `json:"fileName"`       // 相对路径，包含文件名
+	Checksum       string    `json:"checksum"`       // 客户端提供的sha1
+	Size           int64     `json:"size"`           // 文件总大小
+	ChunkCount     int       `json:"chunkCount"`     // 总块数
+	NextChunkIndex int       `json:"nextChunkIndex"` // 下一个需要的分片索引，小于该值的分片都已收到
+	Offset         int64     `json:"offset"`         // 已写入的字节数，即下一个分片的写入位置
+	StartedAt      time.Time `json:"startedAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+	targetFile     string    // 目标文件的绝对路径，位于用户的照片目录下
+	tempFile       string    // 上传中的临时文件，文件名包含会话ID，同一路径的不同会话不会写入同一个文件；所有分片写完并校验后才重命名为targetFile
+	fd             *os.File
+	hash           hash.Hash  // 已写入数据的sha1，随分片写入增量计算
+	meta           FileChunk  // 创建会话时的文件信息，HTTP上传完成时使用
+	actor          auditActor // 创建会话的操作者，上传结束时记录审计事件
+	mu             sync.Mutex // 写入数据、完成和丢弃上传时持有，同一时间只有一个请求写入，写入大文件时会持有很久
+	progressMu     sync.Mutex // 保护Offset、NextChunkIndex和UpdatedAt，写入时只在更新进度时短暂持有
+}
+
+var uploadSessions = make(map[string]*UploadSession)
+var uploadSessionsLock sync.Mutex
+
+// 会话的key，没有checksum时只能使用路径
+func uploadSessionKey(userId uint, fileName string, checksum string) string {
+	return fmt.Sprintf("%d|%s|%s", userId, fileName, checksum)
+}
+
+// 查找用户的文件对应的上传会话，不存在则返回nil
+func findUploadSession(userId uint, fileName string, checksum string) *UploadSession {
+	uploadSessionsLock.Lock()
+	defer uploadSessionsLock.Unlock()
+	return uploadSessions[uploadSessionKey(userId, fileName, checksum)]
+}
+
+// 通过ID查找用户的上传会话，不存在或者属于其他用户则返回nil
+func findUploadSessionById(userId uint, id string) *UploadSession {
+	uploadSessionsLock.Lock()
+	defer uploadSessionsLock.Unlock()
+	for _, s := range uploadSessions {
+		if s.ID == id && s.UserId == userId {
+			return s
+		}
+	}
+	return nil
+}
+
+// 查找或创建文件对应的上传会话，新的上传在写入任何数据之前检查存储配额
+// 文件大小必须大于0，写入的数据不能超过声明的大小，否则无法按大小预留空间
+// 已有会话的文件大小和分块数与本次一致时继续使用，续传的文件已经计入了预留空间
+// 不一致说明是另一个文件，按新的大小检查配额，通过后丢弃旧会话重新开始
+// 统计预留空间、检查配额和保存会话在同一个锁内完成，避免并发的上传同时通过检查后超出配额
+func reserveUploadSession(user *models.User, chunk *FileChunk, actor auditActor) (*UploadSession, error) {
+	if chunk.Size <= 0 {
+		return nil, fmt.Errorf("文件大小错误: %d", chunk.Size)
+	}
+	key := uploadSessionKey(user.ID, chunk.FileName, chunk.Checksum)
+	uploadSessionsLock.Lock()
+	defer uploadSessionsLock.Unlock()
+	old, ok := uploadSessions[key]
+	if ok && old.Size == chunk.Size && old.ChunkCount == chunk.ChunkCount {
+		return old, nil
+	}
+	// 正在上传还未入库的文件占用的空间，要替换的旧会话不再占用空间
+	var userReserved, globalReserved int64
+	for k, s := range uploadSessions {
+		if k == key {
+			continue
+		}
+		globalReserved += s.Size
+		if s.UserId == user.ID {
+			userReserved += s.Size
+		}
+	}
+	if err := models.CheckQuota(user.ID, chunk.Size, userReserved, globalReserved); err != nil {
+		return nil, err
+	}
+	if ok {
+		helpers.AppLogger.Infof("文件 %s 的上传会话与新的分片信息不一致，重新开始上传", chunk.FileName)
+		delete(uploadSessions, key)
+	}
+	now := time.Now()
+	id := newUploadSessionId()
+	targetFile := filepath.Join(user.RootDir(), chunk.FileName)
+	s := &UploadSession{
+		ID:         id,
+		Key:        key,
+		UserId:     user.ID,
+		FileName:   chunk.FileName,
+		Checksum:   chunk.Checksum,
+		Size:       chunk.Size,
+		ChunkCount: chunk.ChunkCount,
+		StartedAt:  now,
+		UpdatedAt:  now,
+		targetFile: targetFile,
+		tempFile:   targetFile + "." + id + helpers.UploadingExt,
+		hash:       sha1.New(),
+		meta:       *chunk,
+		actor:      actor,
+	}
+	uploadSessions[key] = s
+	return s, nil
+}
+
+// 生成随机的会话ID
+func newUploadSessionId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// 移除上传会话，文件句柄由调用方关闭
+func removeUploadSession(s *UploadSession) {
+	uploadSessionsLock.Lock()
+	defer uploadSessionsLock.Unlock()
+	if cur, ok := uploadSessions[s.Key]; ok && cur == s {
+		delete(uploadSessions, s.Key)
+	}
+}
+
+// 打开临时文件并定位到已确认的位置
+// 首次写入（或者断线重连后）会截断到已确认的位置，丢弃上次中断时可能写了一半的数据
+func (s *UploadSession) open() error {
+	if s.fd != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(s.tempFile), 0755); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(s.tempFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := fd.Truncate(s.Offset); err != nil {
+		fd.Close()
+		return err
+	}
+	if _, err := fd.Seek(s.Offset, io.SeekStart); err != nil {
+		fd.Close()
+		return err
+	}
+	s.fd = fd
+	return nil
+}
+
+// 将分片写入到会话的当前位置
+func (s *UploadSession) Write(data []byte) error {
+	if s.Offset+int64(len(data)) > s.Size {
+		return fmt.Errorf("收到的数据超过声明的文件大小 %d 字节", s.Size)
+	}
+	if err := s.open(); err != nil {
+		return err
+	}
+	if _, err := s.fd.Write(data); err != nil {
+		// 写入失败后关闭句柄，下次写入时会截断到已确认的位置
+		s.Close()
+		return err
+	}
+	s.hash.Write(data)
+	s.advance(int64(len(data)), 1)
+	return nil
+}
+
+// 从流中读取数据追加到会话的当前位置，返回写入的字节数
+// 读取中断时已经写入的数据仍然有效，客户端可以从新的Offset继续
+func (s *UploadSession) ReadFrom(r io.Reader) (int64, error) {
+	if err := s.open(); err != nil {
+		return 0, err
+	}
+	var written int64
+	buf := make([]byte, 256*1024)
+	for {
+		nr, readErr := r.Read(buf)
+		if nr > 0 {
+			if _, err := s.fd.Write(buf[:nr]); err != nil {
+				// 写入失败后关闭句柄，下次写入时会截断到已确认的位置
+				s.Close()
+				return written, err
+			}
+			s.hash.Write(buf[:nr])
+			s.advance(int64(nr), 0)
+			written += int64(nr)
+		}
+		if readErr == io.EOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, readErr
+		}
+	}
+}
+
+// 更新写入进度，调用方需要持有mu
+func (s *UploadSession) advance(bytes int64, chunks int) {
+	s.progressMu.Lock()
+	defer s.progressMu.Unlock()
+	s.Offset += bytes
+	s.NextChunkIndex += chunks
+	s.UpdatedAt = time.Now()
+}
+
+// 当前的写入进度：已写入的字节数、下一个需要的分片索引和最后写入时间
+// 不需要持有mu，不会被正在写入的数据阻塞；持有mu时也可以直接读取这些字段
+func (s *UploadSession) progress() (int64, int, time.Time) {
+	s.progressMu.Lock()
+	defer s.progressMu.Unlock()
+	return s.Offset, s.NextChunkIndex, s.UpdatedAt
+}
+
+// 丢弃已收到的数据，从第一个分片重新开始
+func (s *UploadSession) Reset() {
+	s.Close()
+	s.progressMu.Lock()
+	s.Offset = 0
+	s.NextChunkIndex = 0
+	s.progressMu.Unlock()
+	s.hash.Reset()
+}
+
+// 服务器根据实际收到的数据计算出的sha1
+func (s *UploadSession) Sum() string {
+	return hex.EncodeToString(s.hash.Sum(nil))
+}
+
+// 关闭会话的文件句柄，会话本身保留
+func (s *UploadSession) Close() {
+	if s.fd != nil {
+		s.fd.Close()
+		s.fd = nil
+	}
+}
+
+// 是否所有数据都已收到，HTTP上传没有分片数，按字节数判断
+func (s *UploadSession) Complete() bool {
+	if s.ChunkCount > 0 {
+		return s.NextChunkIndex >= s.ChunkCount
+	}
+	return s.Offset >= s.Size
+}
+
+// 所有分片收到后，将临时文件落盘并校验大小
+// 失败时删除临时文件，客户端需要重新上传
+func (s *UploadSession) Seal() error {
+	err := s.seal()
+	if err != nil {
+		s.Discard()
+	}
+	return err
+}
+
+func (s *UploadSession) seal() error {
+	if s.fd != nil {
+		if err := s.fd.Sync(); err != nil {
+			return fmt.Errorf("文件落盘失败: %v", err)
+		}
+		s.Close()
+	}
+	info, err := os.Stat(s.tempFile)
+	if err != nil {
+		return err
+	}
+	if info.Size() != s.Size {
+		return fmt.Errorf("文件大小不一致，声明 %d 字节，实际收到 %d 字节", s.Size, info.Size())
+	}
+	return nil
+}
+
+// 将校验通过的临时文件重命名为最终的文件名
+func (s *UploadSession) Commit() error {
+	if err := os.Rename(s.tempFile, s.targetFile); err != nil {
+		s.Discard()
+		return fmt.Errorf("重命名临时文件失败: %v", err)
+	}
+	return nil
+}
+
+// 丢弃上传的临时文件（例如校验失败或者checksum已存在）
+func (s *UploadSession) Discard() {
+	s.Close()
+	if err := os.Remove(s.tempFile); err != nil && !os.IsNotExist(err) {
+		helpers.AppLogger.Errorf("删除上传临时文件失败: %s: %v", s.tempFile, err)
+	}
+}
+
+// 清理长时间没有数据的上传会话，同时删除未完成的文件
+// 正在写入的会话（例如卡住的HTTP请求）跳过，等待下次清理
+func CleanupExpiredUploadSessions() {
+	expired := make([]*UploadSession, 0)
+	uploadSessionsLock.Lock()
+	for key, s := range uploadSessions {
+		if _, _, updatedAt := s.progress(); time.Since(updatedAt) <= uploadSessionIdleTimeout {
+			continue
+		}
+		if !s.mu.TryLock() {
+			continue
+		}
+		expired = append(expired, s)
+		delete(uploadSessions, key)
+	}
+	uploadSessionsLock.Unlock()
+	for _, s := range expired {
+		s.Discard()
+		recordUploadFinished(s, UploadOutcomeFailed, "上传超时")
+		s.mu.Unlock()
+		helpers.AppLogger.Infof("清理过期的上传会话: %s", s.FileName)
+	}
+}
@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/qicfan/backup-server/models"
+)
+
+func resetUploadSessions(t *testing.T) {
+	t.Helper()
+	uploadSessionsLock.Lock()
+	uploadSessions = make(map[string]*UploadSession)
+	uploadSessionsLock.Unlock()
+	t.Cleanup(func() {
+		uploadSessionsLock.Lock()
+		uploadSessions = make(map[string]*UploadSession)
+		uploadSessionsLock.Unlock()
+	})
+}
+
+func TestReserveUploadSessionRedeclaredSize(t *testing.T) {
+	resetUploadSessions(t)
+	user, err := models.CreateUser("redeclare", "password", models.RoleMember, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunk := FileChunk{FileName: "a.jpg", Checksum: "abc", Size: 1, ChunkCount: 1}
+	first, err := reserveUploadSession(user, &chunk, auditActor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 相同路径和checksum的文件续传时使用已有的会话
+	if s, err := reserveUploadSession(user, &chunk, auditActor{}); err != nil || s != first {
+		t.Fatalf("resume: session = %p, err = %v, want %p", s, err, first)
+	}
+	// 重新声明更大的文件大小时按新的大小检查配额
+	larger := chunk
+	larger.Size = 1000
+	if _, err := reserveUploadSession(user, &larger, auditActor{}); !errors.Is(err, models.ErrQuotaExceeded) {
+		t.Fatalf("redeclare 1000 bytes: err = %v, want %v", err, models.ErrQuotaExceeded)
+	}
+	if s := findUploadSession(user.ID, chunk.FileName, chunk.Checksum); s != first {
+		t.Errorf("session replaced after rejected redeclare")
+	}
+	// 配额内的新大小替换旧会话，旧会话的预留空间不再计入
+	larger.Size = 100
+	s, err := reserveUploadSession(user, &larger, auditActor{})
+	if err != nil {
+		t.Fatalf("redeclare 100 bytes: %v", err)
+	}
+	if s == first || s.Size != 100 {
+		t.Errorf("redeclare 100 bytes: got session %p size %d", s, s.Size)
+	}
+	for _, c := range []struct {
+		size int64
+		want string
+	}{
+		{0, "文件大小错误: 0"},
+		{-1, "文件大小错误: -1"},
+	} {
+		bad := FileChunk{FileName: "b.jpg", Size: c.size}
+		if _, err := reserveUploadSession(user, &bad, auditActor{}); err == nil || err.Error() != c.want {
+			t.Errorf("size %d: err = %v, want %s", c.size, err, c.want)
+		}
+	}
+}
+
+func TestReserveUploadSessionConcurrent(t *testing.T) {
+	resetUploadSessions(t)
+	user, err := models.CreateUser("concurrent", "password", models.RoleMember, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 每个文件30字节，配额100字节，并发上传时最多只能预留3个
+	var allowed int
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			chunk := FileChunk{FileName: fmt.Sprintf("%d.jpg", i), Checksum: fmt.Sprint(i), Size: 30, ChunkCount: 1}
+			if _, err := reserveUploadSession(user, &chunk, auditActor{}); err == nil {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != 3 {
+		t.Errorf("allowed = %d, want 3", allowed)
+	}
+}
+
+func TestUploadSessionsForSamePathUseSeparateTempFiles(t *testing.T) {
+	resetUploadSessions(t)
+	user, err := models.CreateUser("tempfile", "password", models.RoleMember, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 同一路径的两次上传内容不同，交替写入后各自提交的都是自己的数据
+	a, err := reserveUploadSession(user, &FileChunk{FileName: "same.jpg", Checksum: "a", Size: 3, ChunkCount: 1}, auditActor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := reserveUploadSession(user, &FileChunk{FileName: "same.jpg", Checksum: "b", Size: 3, ChunkCount: 1}, auditActor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.tempFile == b.tempFile {
+		t.Fatalf("sessions share temp file %s", a.tempFile)
+	}
+	if err := a.Write([]byte("aaa")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Write([]byte("bbb")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*UploadSession{b, a} {
+		if err := s.Seal(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(s.targetFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := s.Checksum + s.Checksum + s.Checksum; string(data) != want {
+			t.Errorf("session %s committed %q, want %q", s.Checksum, data, want)
+		}
+	}
+}
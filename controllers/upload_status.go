@@ -0,0 +1,116 @@
+package controllers
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/models"
+)
+
+// 上传的最终结果
+const (
+	UploadOutcomeUploading    = "uploading"    // 正在上传
+	UploadOutcomeStored       = "stored"       // 已保存并入库
+	UploadOutcomeDeduplicated = "deduplicated" // checksum已存在，上传的文件被丢弃
+	UploadOutcomeFailed       = "failed"       // 校验失败、保存失败、过期或被终止
+)
+
+// 最多保留多少条已结束的上传记录
+const maxFinishedUploads = 200
+
+// 上传的状态
+type UploadStatus struct {
+	ID             string `json:"id"`
+	UserId         uint   `json:"userId"`         // 上传文件的用户
+	FileName       string `json:"fileName"`       // 相对路径，包含文件名
+	Size           int64  `json:"size"`           // 文件总大小
+	BytesReceived  int64  `json:"bytesReceived"`  // 已收到的字节数
+	ChunkCount     int    `json:"chunkCount"`     // 总块数，HTTP上传为0
+	ChunksReceived int    `json:"chunksReceived"` // 已收到的分片数
+	StartedAt      int64  `json:"startedAt"`      // 开始时间，Unix时间戳，单位秒
+	FinishedAt     int64  `json:"finishedAt"`     // 结束时间，未结束为0
+	Throughput     int64  `json:"throughput"`     // 平均速度，单位字节/秒
+	Outcome        string `json:"outcome"`        // 结果：uploading/stored/deduplicated/failed
+	Message        string `json:"message"`        // 失败原因
+}
+
+var finishedUploads = make([]UploadStatus, 0)
+var finishedUploadsLock sync.Mutex
+
+// 生成会话的当前状态，读取的是进度的快照，不需要持有session.mu，不会被正在写入的数据阻塞
+func (s *UploadSession) status(outcome string, message string, finishedAt time.Time) UploadStatus {
+	end := finishedAt
+	if end.IsZero() {
+		end = time.Now()
+	}
+	offset, nextChunkIndex, _ := s.progress()
+	var throughput int64
+	if elapsed := end.Sub(s.StartedAt).Seconds(); elapsed > 0 {
+		throughput = int64(float64(offset) / elapsed)
+	}
+	status := UploadStatus{
+		ID:             s.ID,
+		UserId:         s.UserId,
+		FileName:       s.FileName,
+		Size:           s.Size,
+		BytesReceived:  offset,
+		ChunkCount:     s.ChunkCount,
+		ChunksReceived: nextChunkIndex,
+		StartedAt:      s.StartedAt.Unix(),
+		Throughput:     throughput,
+		Outcome:        outcome,
+		Message:        message,
+	}
+	if !finishedAt.IsZero() {
+		status.FinishedAt = finishedAt.Unix()
+	}
+	return status
+}
+
+// 记录上传的最终结果，调用方需要持有session.mu
+func recordUploadFinished(s *UploadSession, outcome string, message string) {
+	status := s.status(outcome, message, time.Now())
+	detail := outcome
+	if message != "" {
+		detail += ": " + message
+	}
+	s.actor.record(models.AuditUpload, s.FileName, outcome != UploadOutcomeFailed, detail)
+	finishedUploadsLock.Lock()
+	defer finishedUploadsLock.Unlock()
+	finishedUploads = append(finishedUploads, status)
+	if len(finishedUploads) > maxFinishedUploads {
+		finishedUploads = finishedUploads[len(finishedUploads)-maxFinishedUploads:]
+	}
+}
+
+// 上传状态：正在进行的上传和最近结束的上传
+// 普通用户只能看到自己的上传，管理员可以看到所有用户的上传
+func HandleUploadStatus(c *gin.Context) {
+	user := currentUser(c)
+	uploadSessionsLock.Lock()
+	sessions := make([]*UploadSession, 0, len(uploadSessions))
+	for _, s := range uploadSessions {
+		if user.IsAdmin() || s.UserId == user.ID {
+			sessions = append(sessions, s)
+		}
+	}
+	uploadSessionsLock.Unlock()
+	active := make([]UploadStatus, 0, len(sessions))
+	for _, s := range sessions {
+		active = append(active, s.status(UploadOutcomeUploading, "", time.Time{}))
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].StartedAt > active[j].StartedAt })
+	finishedUploadsLock.Lock()
+	finished := make([]UploadStatus, 0, len(finishedUploads))
+	// 最近结束的排在前面
+	for i := len(finishedUploads) - 1; i >= 0; i-- {
+		if user.IsAdmin() || finishedUploads[i].UserId == user.ID {
+			finished = append(finished, finishedUploads[i])
+		}
+	}
+	finishedUploadsLock.Unlock()
+	c.JSON(http.StatusOK, APIResponse[map[string][]UploadStatus]{Code: Success, Message: "", Data: map[string][]UploadStatus{"active": active, "finished": finished}})
+}
@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/models"
+)
+
+func TestUploadStatusDuringWrite(t *testing.T) {
+	resetUploadSessions(t)
+	user, err := models.CreateUser("uploadstatus", "password", models.RoleMember, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := reserveUploadSession(user, &FileChunk{FileName: "a.mp4", Checksum: "a", Size: 10, ChunkCount: 2}, auditActor{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	defer session.Discard()
+	if err := session.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	// 写入数据时持有session.mu，状态接口不需要等待
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/upload/status", func(c *gin.Context) { c.Set("user", user) }, HandleUploadStatus)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/upload/status", nil))
+		done <- w
+	}()
+	var w *httptest.ResponseRecorder
+	select {
+	case w = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upload status blocked by session being written")
+	}
+	var resp APIResponse[map[string][]UploadStatus]
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	active := resp.Data["active"]
+	if len(active) != 1 || active[0].BytesReceived != 5 || active[0].ChunksReceived != 1 {
+		t.Errorf("active = %+v, want one upload with 5 bytes and 1 chunk", active)
+	}
+}
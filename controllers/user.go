@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/qicfan/backup-server/helpers"
+	"github.com/qicfan/backup-server/models"
+)
+
+type CreateUserRequest struct {
+	Username string `json:"username" form:"username" binding:"required"`
+	Password string `json:"password" form:"password" binding:"required"`
+	Role     string `json:"role" form:"role"`   // 角色：admin/member/readonly/uploadonly，默认member
+	Quota    int64  `json:"quota" form:"quota"` // 存储配额，单位字节，0表示使用默认配额，不能小于0
+}
+
+type UpdateUserRequest struct {
+	ID        uint   `json:"id" form:"id" binding:"required"`
+	Password  string `json:"password" form:"password"`     // 为空则不修改密码
+	Role      string `json:"role" form:"role"`             // 为空则不修改
+	Quota     *int64 `json:"quota" form:"quota"`           // 为空则不修改，不能小于0
+	ResetTotp bool   `json:"reset_totp" form:"reset_totp"` // 关闭用户的两步验证，用户丢失验证器和恢复码时使用
+}
+
+type DisableUserRequest struct {
+	ID       uint `json:"id" form:"id" binding:"required"`
+	Disabled bool `json:"disabled" form:"disabled"`
+}
+
+type UserIdRequest struct {
+	ID uint `json:"id" form:"id" binding:"required"`
+}
+
+// 用户列表
+func HandleUserList(c *gin.Context) {
+	users, err := models.ListUsers()
+	if err != nil {
+		helpers.AppLogger.Errorf("查询用户列表失败: %v", err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "查询用户列表失败", Data: nil})
+		return
+	}
+	c.JSON(http.StatusOK, APIResponse[[]*models.User]{Code: Success, Message: "", Data: users})
+}
+
+// 创建用户
+func HandleUserCreate(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	if req.Role == "" {
+		req.Role = models.RoleMember
+	}
+	user, err := models.CreateUser(req.Username, req.Password, req.Role, req.Quota)
+	if err != nil {
+		helpers.AppLogger.Errorf("创建用户 %s 失败: %v", req.Username, err)
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "创建用户失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AppLogger.Infof("%s 创建了用户 %s", currentUser(c).Username, user.Username)
+	audit(c, models.AuditUserCreate, user.Username, fmt.Sprintf("role=%s quota=%d", user.Role, user.Quota))
+	c.JSON(http.StatusOK, APIResponse[*models.User]{Code: Success, Message: "", Data: user})
+}
+
+// 修改用户的密码、角色和配额，或者重置两步验证
+func HandleUserUpdate(c *gin.Context) {
+	var req UpdateUserRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user, err := models.GetUserById(req.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "用户不存在", Data: nil})
+		return
+	}
+	if req.Quota != nil && *req.Quota < 0 {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: models.ErrInvalidQuota.Error(), Data: nil})
+		return
+	}
+	// 只更新请求中修改的字段，不覆盖其他请求同时修改的字段
+	columns := make([]string, 0)
+	if req.Password != "" {
+		if err := user.SetPassword(req.Password); err != nil {
+			c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "修改密码失败: " + err.Error(), Data: nil})
+			return
+		}
+		columns = append(columns, "password_hash")
+	}
+	if req.Role != "" {
+		if !models.ValidRole(req.Role) {
+			c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "不支持的角色: " + req.Role, Data: nil})
+			return
+		}
+		if req.Role != models.RoleAdmin && user.IsAdmin() && !keepsActiveAdmin(user) {
+			c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "至少需要保留一个管理员", Data: nil})
+			return
+		}
+		user.Role = req.Role
+		columns = append(columns, "role")
+	}
+	if req.Quota != nil {
+		user.Quota = *req.Quota
+		columns = append(columns, "quota")
+	}
+	if len(columns) > 0 {
+		if err := user.UpdateColumns(columns...); err != nil {
+			helpers.AppLogger.Errorf("修改用户 %s 失败: %v", user.Username, err)
+			c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "修改用户失败: " + err.Error(), Data: nil})
+			return
+		}
+	}
+	if req.ResetTotp && user.TotpEnabled {
+		if err := user.DisableTOTP(); err != nil {
+			helpers.AppLogger.Errorf("关闭用户 %s 的两步验证失败: %v", user.Username, err)
+		} else {
+			helpers.AuthLogger.Infof("%s 关闭了用户 %s 的两步验证", currentUser(c).Username, user.Username)
+		}
+	}
+	if req.Password != "" {
+		// 修改密码后所有设备需要重新登录，管理员修改自己的密码时保留当前设备
+		var keepSession uint
+		if session := currentSession(c); session != nil && user.ID == currentUser(c).ID {
+			keepSession = session.ID
+		}
+		if err := models.RevokeUserSessions(user.ID, keepSession); err != nil {
+			helpers.AppLogger.Errorf("撤销用户 %s 的登录设备失败: %v", user.Username, err)
+		}
+	}
+	helpers.AppLogger.Infof("%s 修改了用户 %s", currentUser(c).Username, user.Username)
+	audit(c, models.AuditUserUpdate, user.Username, userUpdateDetail(&req))
+	c.JSON(http.StatusOK, APIResponse[*models.User]{Code: Success, Message: "", Data: user})
+}
+
+// 禁用或启用用户，禁用后该用户已签发的Token立即失效，所有登录设备被撤销
+func HandleUserDisable(c *gin.Context) {
+	var req DisableUserRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user, err := models.GetUserById(req.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "用户不存在", Data: nil})
+		return
+	}
+	if req.Disabled && (user.ID == currentUser(c).ID || !keepsActiveAdmin(user)) {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "不能禁用自己或最后一个管理员", Data: nil})
+		return
+	}
+	user.Disabled = req.Disabled
+	if err := user.UpdateColumns("disabled"); err != nil {
+		helpers.AppLogger.Errorf("禁用用户 %s 失败: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "禁用用户失败: " + err.Error(), Data: nil})
+		return
+	}
+	if user.Disabled {
+		if err := models.RevokeUserSessions(user.ID, 0); err != nil {
+			helpers.AppLogger.Errorf("撤销用户 %s 的登录设备失败: %v", user.Username, err)
+		}
+	}
+	helpers.AppLogger.Infof("%s 将用户 %s 的禁用状态修改为 %v", currentUser(c).Username, user.Username, user.Disabled)
+	audit(c, models.AuditUserDisable, user.Username, fmt.Sprintf("disabled=%v", user.Disabled))
+	c.JSON(http.StatusOK, APIResponse[*models.User]{Code: Success, Message: "", Data: user})
+}
+
+// 删除用户
+func HandleUserDelete(c *gin.Context) {
+	var req UserIdRequest
+	if err := c.ShouldBind(&req); err != nil {
+		c.JSON(http.StatusBadRequest, APIResponse[any]{Code: BadRequest, Message: "请求参数错误: " + err.Error(), Data: nil})
+		return
+	}
+	user, err := models.GetUserById(req.ID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, APIResponse[any]{Code: BadRequest, Message: "用户不存在", Data: nil})
+		return
+	}
+	if user.ID == currentUser(c).ID || !keepsActiveAdmin(user) {
+		c.JSON(http.StatusOK, APIResponse[any]{Code: BadRequest, Message: "不能删除自己或最后一个管理员", Data: nil})
+		return
+	}
+	if err := models.DeleteUser(user.ID); err != nil {
+		helpers.AppLogger.Errorf("删除用户 %s 失败: %v", user.Username, err)
+		c.JSON(http.StatusInternalServerError, APIResponse[any]{Code: BadRequest, Message: "删除用户失败: " + err.Error(), Data: nil})
+		return
+	}
+	helpers.AppLogger.Infof("%s 删除了用户 %s", currentUser(c).Username, user.Username)
+	audit(c, models.AuditUserDelete, user.Username, "")
+	c.JSON(http.StatusOK, APIResponse[any]{Code: Success, Message: "删除成功", Data: nil})
+}
+
+// 审计事件中记录修改了哪些内容，不记录密码
+func userUpdateDetail(req *UpdateUserRequest) string {
+	changes := make([]string, 0)
+	if req.Password != "" {
+		changes = append(changes, "password")
+	}
+	if req.Role != "" {
+		changes = append(changes, "role="+req.Role)
+	}
+	if req.Quota != nil {
+		changes = append(changes, fmt.Sprintf("quota=%d", *req.Quota))
+	}
+	if req.ResetTotp {
+		changes = append(changes, "reset_totp")
+	}
+	return strings.Join(changes, " ")
+}
+
+// 移除user的管理员身份后是否还有其他可用的管理员
+func keepsActiveAdmin(user *models.User) bool {
+	if !user.IsAdmin() || user.Disabled {
+		return true
+	}
+	count, err := models.CountActiveAdmins()
+	return err == nil && count > 1
+}
@@ -4,6 +4,16 @@ var RootDir string = ""
 
 var UPLOAD_ROOT_DIR = "/upload"
 
+// JWT签名密钥，启动时从JWT_SECRET环境变量或者config/jwt.secret加载
+var JwtSecret []byte
+
+// 存储配额，单位字节，0表示不限制
+var GlobalQuota int64 = 0 // 所有照片总共可以使用的空间
+var UserQuota int64 = 0   // 每个账号默认可以使用的空间
+
+// 上传中的临时文件扩展名，上传完成后才重命名为最终文件名
+const UploadingExt = ".uploading"
+
 type ClientOS string
 
 const (
@@ -0,0 +1,292 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrMetadataToolMissing = errors.New("ImageMagick未安装，且文件中没有XMP元数据")
+
+// identify读取一张图片的超时时间，超大或损坏的图片解码时间过长时放弃读取
+const identifyTimeout = time.Minute
+
+// 图片的拍摄信息，从EXIF中读取，EXIF中没有的字段再从XMP中读取
+type ImageMetadata struct {
+	TakenAt      int64    // 拍摄时间，Unix时间戳，单位秒，0表示未知
+	CameraMake   string   // 相机厂商
+	CameraModel  string   // 相机型号
+	LensModel    string   // 镜头型号
+	ExposureTime string   // 曝光时间，如 1/120
+	FNumber      float64  // 光圈值
+	ISO          int      // 感光度
+	FocalLength  float64  // 焦距，单位毫米
+	Orientation  int      // EXIF方向，1-8，0表示未知
+	Width        int      // 宽度，单位像素
+	Height       int      // 高度，单位像素
+	Latitude     *float64 // 纬度，南纬为负数，nil表示没有位置信息
+	Longitude    *float64 // 经度，西经为负数
+}
+
+// XMP数据包最多在文件的前多少字节中查找，相机和手机都把元数据写在文件开头
+const xmpScanLimit = 4 * 1024 * 1024
+
+// 读取JPEG、HEIC、PNG等图片的拍摄信息
+// 优先使用ImageMagick的identify读取EXIF，缺失的字段使用文件中的XMP数据包补全
+func ExtractImageMetadata(fullPath string) (*ImageMetadata, error) {
+	meta := &ImageMetadata{}
+	exifErr := readExifByIdentify(fullPath, meta)
+	if exifErr != nil {
+		AppLogger.Warnf("读取 %s 的EXIF失败: %v", fullPath, exifErr)
+	}
+	hasXmp, err := readXmp(fullPath, meta)
+	if err != nil {
+		AppLogger.Warnf("读取 %s 的XMP失败: %v", fullPath, err)
+	}
+	if errors.Is(exifErr, exec.ErrNotFound) && !hasXmp {
+		return nil, ErrMetadataToolMissing
+	}
+	return meta, nil
+}
+
+// identify命令，ImageMagick 7使用magick identify，6使用identify
+func identifyCommand(ctx context.Context, args ...string) (*exec.Cmd, error) {
+	if _, err := exec.LookPath("magick"); err == nil {
+		return exec.CommandContext(ctx, "magick", append([]string{"identify"}, args...)...), nil
+	}
+	if _, err := exec.LookPath("identify"); err != nil {
+		return nil, err
+	}
+	return exec.CommandContext(ctx, "identify", args...), nil
+}
+
+// 使用identify输出图片的尺寸和所有EXIF属性，每行一个 exif:Name=Value
+func readExifByIdentify(fullPath string, meta *ImageMetadata) error {
+	ctx, cancel := context.WithTimeout(context.Background(), identifyTimeout)
+	defer cancel()
+	cmd, err := identifyCommand(ctx, "-quiet", "-format", "size=%w %h\n%[EXIF:*]", fullPath+"[0]")
+	if err != nil {
+		return err
+	}
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return fmt.Errorf("identify 读取图片信息超时: %v", ctx.Err())
+	}
+	if err != nil && len(output) == 0 {
+		return err
+	}
+	exif := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if size, ok := strings.CutPrefix(line, "size="); ok {
+			parts := strings.Fields(size)
+			if len(parts) == 2 {
+				meta.Width, _ = strconv.Atoi(parts[0])
+				meta.Height, _ = strconv.Atoi(parts[1])
+			}
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok {
+			exif[strings.TrimPrefix(strings.ToLower(key), "exif:")] = strings.TrimSpace(value)
+		}
+	}
+	meta.TakenAt = parseExifTime(firstNonEmpty(exif["datetimeoriginal"], exif["datetimedigitized"], exif["datetime"]), firstNonEmpty(exif["offsettimeoriginal"], exif["offsettime"]))
+	meta.CameraMake = exif["make"]
+	meta.CameraModel = exif["model"]
+	meta.LensModel = exif["lensmodel"]
+	meta.ExposureTime = exif["exposuretime"]
+	meta.FNumber = parseRational(exif["fnumber"])
+	meta.ISO, _ = strconv.Atoi(firstField(firstNonEmpty(exif["photographicsensitivity"], exif["isospeedratings"])))
+	meta.FocalLength = parseRational(exif["focallength"])
+	meta.Orientation, _ = strconv.Atoi(exif["orientation"])
+	lat, latOk := parseExifCoordinate(exif["gpslatitude"], exif["gpslatituderef"])
+	lng, lngOk := parseExifCoordinate(exif["gpslongitude"], exif["gpslongituderef"])
+	if latOk && lngOk {
+		meta.Latitude = &lat
+		meta.Longitude = &lng
+	}
+	return nil
+}
+
+var xmpPacketStart = []byte("<x:xmpmeta")
+var xmpPacketEnd = []byte("</x:xmpmeta>")
+
+// 在文件开头查找XMP数据包，用其中的值补全EXIF中缺失的字段，返回是否找到XMP
+func readXmp(fullPath string, meta *ImageMetadata) (bool, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, xmpScanLimit))
+	if err != nil {
+		return false, err
+	}
+	start := bytes.Index(data, xmpPacketStart)
+	if start < 0 {
+		return false, nil
+	}
+	end := bytes.Index(data[start:], xmpPacketEnd)
+	if end < 0 {
+		return false, nil
+	}
+	xmp := parseXmpValues(string(data[start : start+end]))
+	if meta.TakenAt == 0 {
+		meta.TakenAt = parseXmpTime(firstNonEmpty(xmp["exif:DateTimeOriginal"], xmp["photoshop:DateCreated"], xmp["xmp:CreateDate"]))
+	}
+	if meta.CameraMake == "" {
+		meta.CameraMake = xmp["tiff:Make"]
+	}
+	if meta.CameraModel == "" {
+		meta.CameraModel = xmp["tiff:Model"]
+	}
+	if meta.LensModel == "" {
+		meta.LensModel = firstNonEmpty(xmp["exifEX:LensModel"], xmp["aux:Lens"])
+	}
+	if meta.Orientation == 0 {
+		meta.Orientation, _ = strconv.Atoi(xmp["tiff:Orientation"])
+	}
+	if meta.Latitude == nil {
+		lat, latOk := parseXmpCoordinate(xmp["exif:GPSLatitude"])
+		lng, lngOk := parseXmpCoordinate(xmp["exif:GPSLongitude"])
+		if latOk && lngOk {
+			meta.Latitude = &lat
+			meta.Longitude = &lng
+		}
+	}
+	return true, nil
+}
+
+// XMP中的属性，属性形式 name="value" 和元素形式 <name>value</name>，Go的正则不支持反向引用，元素的开始和结束标签在代码中比较
+var (
+	xmpAttrPattern    = regexp.MustCompile(`([A-Za-z][\w.-]*:[\w.-]+)="([^"]*)"`)
+	xmpElementPattern = regexp.MustCompile(`<([A-Za-z][\w.-]*:[\w.-]+)>([^<]*)</([A-Za-z][\w.-]*:[\w.-]+)>`)
+)
+
+// 一次读取XMP数据包中的所有属性，同名属性以第一次出现的为准，属性形式优先于元素形式
+func parseXmpValues(packet string) map[string]string {
+	values := make(map[string]string)
+	for _, m := range xmpAttrPattern.FindAllStringSubmatch(packet, -1) {
+		if _, ok := values[m[1]]; !ok {
+			values[m[1]] = strings.TrimSpace(m[2])
+		}
+	}
+	for _, m := range xmpElementPattern.FindAllStringSubmatch(packet, -1) {
+		if _, ok := values[m[1]]; !ok && m[1] == m[3] {
+			values[m[1]] = strings.TrimSpace(m[2])
+		}
+	}
+	return values
+}
+
+// 解析EXIF时间 2006:01:02 15:04:05，offset为 +08:00 格式的时区，没有时区时按服务器时区处理
+func parseExifTime(value string, offset string) int64 {
+	if value == "" {
+		return 0
+	}
+	loc := time.Local
+	if offset != "" {
+		if t, err := time.Parse("-07:00", offset); err == nil {
+			loc = t.Location()
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", value, loc)
+	if err != nil || t.Year() < 1900 {
+		return 0
+	}
+	return t.Unix()
+}
+
+// 解析XMP中ISO 8601格式的时间，没有时区时按服务器时区处理
+func parseXmpTime(value string) int64 {
+	if value == "" {
+		return 0
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02T15:04:05.999999999", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}
+
+// 解析EXIF的有理数，如 28/10
+func parseRational(value string) float64 {
+	num, den, ok := strings.Cut(strings.TrimSpace(value), "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !ok {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// 解析EXIF的经纬度：度、分、秒三个有理数，如 31/1, 14/1, 2345/100，ref为S或W时取负数
+func parseExifCoordinate(value string, ref string) (float64, bool) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return 0, false
+	}
+	coordinate := parseRational(parts[0]) + parseRational(parts[1])/60 + parseRational(parts[2])/3600
+	return signedCoordinate(coordinate, ref)
+}
+
+// 解析XMP的经纬度：31,14.3906N 或者 31,14,23.45N
+func parseXmpCoordinate(value string) (float64, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	ref := value[len(value)-1:]
+	parts := strings.Split(value[:len(value)-1], ",")
+	var coordinate float64
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || i > 2 {
+			return 0, false
+		}
+		coordinate += v / math.Pow(60, float64(i))
+	}
+	return signedCoordinate(coordinate, ref)
+}
+
+func signedCoordinate(coordinate float64, ref string) (float64, bool) {
+	if coordinate == 0 || coordinate > 180 {
+		return 0, false
+	}
+	if ref = strings.ToUpper(strings.TrimSpace(ref)); ref == "S" || ref == "W" {
+		coordinate = -coordinate
+	}
+	return coordinate, true
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// 多值属性（如 100, 100）只取第一个值
+func firstField(value string) string {
+	first, _, _ := strings.Cut(value, ",")
+	return strings.TrimSpace(first)
+}
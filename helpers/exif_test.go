@@ -0,0 +1,31 @@
+package helpers
+
+import "testing"
+
+func TestParseXmpValues(t *testing.T) {
+	packet := `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:Description xmlns:tiff="http://ns.adobe.com/tiff/1.0/" tiff:Make="Apple" tiff:Model=" iPhone 15 Pro ">
+  <tiff:Make>Canon</tiff:Make>
+  <exif:DateTimeOriginal>2024-05-01T08:30:00+08:00</exif:DateTimeOriginal>
+  <exif:GPSLatitude>31,14.1N</exif:GPSLatitude>
+  <aux:Lens>EF 50mm</exifEX:LensModel>
+ </rdf:Description>`
+	values := parseXmpValues(packet)
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"tiff:Make", "Apple"},
+		{"tiff:Model", "iPhone 15 Pro"},
+		{"exif:DateTimeOriginal", "2024-05-01T08:30:00+08:00"},
+		{"exif:GPSLatitude", "31,14.1N"},
+		{"aux:Lens", ""},
+		{"exifEX:LensModel", ""},
+		{"tiff:Orientation", ""},
+	}
+	for _, c := range cases {
+		if got := values[c.name]; got != c.want {
+			t.Errorf("%s = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
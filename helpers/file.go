@@ -5,10 +5,12 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -56,7 +58,7 @@ func CleanupUploadingFiles() {
 		}
 		// 取扩展名
 		ext := filepath.Ext(info.Name())
-		if ext == ".uploading" {
+		if ext == UploadingExt {
 			if rmErr := os.Remove(path); rmErr != nil {
 				AppLogger.Errorf("删除上传临时文件失败： %s: %v", path, rmErr)
 			} else {
@@ -166,6 +168,26 @@ func Base64Decode(s string) (string, error) {
 	return string(decoded), nil
 }
 
+// 解析容量字符串，如 "500M"、"1.5G"、"2TB"、"1024"，不带单位时为字节
+func ParseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	if s == "" {
+		return 0, nil
+	}
+	units := map[byte]float64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	multiplier := 1.0
+	if unit, ok := units[s[len(s)-1]]; ok {
+		multiplier = unit
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("无法解析容量: %s", s)
+	}
+	return int64(value * multiplier), nil
+}
+
 func BytesSHA256(data []byte) string {
 	h := sha256.Sum256(data)
 	return hex.EncodeToString(h[:])
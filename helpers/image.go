@@ -5,7 +5,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strings"
 )
 
 // 返回缩略图的保存路径
@@ -33,10 +32,21 @@ func GetConvertFilename(srcFilePath string, newExt string) string {
 }
 
 // 生成缩略图
-// path: 原图路径
+// path: 原图路径，相对UPLOAD_ROOT_DIR，不能位于UPLOAD_ROOT_DIR之外
 // size: 缩略图尺寸，如 "100x100"
 // 返回缩略图的完整文件路径
 func Thumbnail(path, size string) (string, error) {
+	relPath, srcFullPath, err := ResolvePath(UPLOAD_ROOT_DIR, path)
+	if err != nil {
+		return "", err
+	}
+	thumbnailPath := GetThumbnailFilename(relPath, size)
+	AppLogger.Infof("生成缩略图:%s => %s, 缩略图路径：%s", path, srcFullPath, thumbnailPath)
+	return thumbnailFile(srcFullPath, thumbnailPath, size)
+}
+
+// 使用ImageMagick为srcFullPath生成缩略图并保存到thumbnailPath，缩略图已存在时直接返回
+func thumbnailFile(srcFullPath string, thumbnailPath string, size string) (string, error) {
 	exeCommand := "magick"
 	if _, err := exec.LookPath(exeCommand); err != nil {
 		AppLogger.Errorf("%s未安装: %v", exeCommand, err)
@@ -45,16 +55,6 @@ func Thumbnail(path, size string) (string, error) {
 			return "", fmt.Errorf("%s未安装: %v", exeCommand, err)
 		}
 	}
-	srcFullPath := filepath.Join(UPLOAD_ROOT_DIR, path)
-	thumbnailPath := GetThumbnailFilename(path, size)
-	if strings.HasPrefix(path, "/") {
-		srcFullPath = path
-		thumbnailPath = fmt.Sprintf("%s_%s.jpg", srcFullPath, size)
-		AppLogger.Infof("使用绝对路径:%s, 缩略图路径：%s", path, thumbnailPath)
-	} else {
-		AppLogger.Infof("使用相对路径:%s => %s, 缩略图路径：%s", path, srcFullPath, thumbnailPath)
-	}
-
 	if !FileExists(thumbnailPath) {
 		// 执行 ImageMagick 缩略图命令，强制输出jpg
 		cmd := exec.Command(exeCommand, srcFullPath, "-thumbnail", size, thumbnailPath)
@@ -80,7 +80,10 @@ func TransImage(srcPath string, format string) (string, string, error) {
 			return "", "", fmt.Errorf("%s未安装: %v", exeCommand, err)
 		}
 	}
-	srcFullPath := filepath.Join(UPLOAD_ROOT_DIR, srcPath)
+	srcPath, srcFullPath, err := ResolvePath(UPLOAD_ROOT_DIR, srcPath)
+	if err != nil {
+		return "", "", err
+	}
 	destPath := fmt.Sprintf("%s%s", srcPath, format)
 	destFullPath := filepath.Join(UPLOAD_ROOT_DIR, destPath)
 
@@ -11,6 +11,9 @@ import (
 
 var AppLogger *logrus.Logger
 
+// 认证相关的审计日志：登录成功、失败、限流和锁定，不能记录密码等凭证
+var AuthLogger *logrus.Logger
+
 func NewLogger(logFileName string) *logrus.Logger {
 	logger := logrus.New()
 	logDir := filepath.Join(RootDir, "config", "logs")
@@ -0,0 +1,75 @@
+package helpers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnsafePath = errors.New("路径不合法，不能访问照片目录之外的文件")
+
+// 将客户端提供的路径解析为root下的路径，所有来自客户端的路径参数都要经过该函数
+// 客户端的路径都是相对root的路径，开头的 / 或 \ 会被忽略；清理 . 和 .. 之后仍然位于root之外的路径会被拒绝
+// 路径中已经存在的部分会解析符号链接，指向root之外的符号链接同样会被拒绝
+// 返回清理后的相对路径（root本身为"."）和绝对路径
+func ResolvePath(root string, path string) (string, string, error) {
+	if strings.ContainsRune(path, 0) {
+		return "", "", ErrUnsafePath
+	}
+	// Windows客户端使用 \ 作为分隔符，所有系统上都把 \ 当作分隔符处理，避免 ..\ 在Windows上逃出root
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimLeft(strings.ReplaceAll(path, "\\", "/"), "/")))
+	if !filepath.IsLocal(rel) {
+		return "", "", ErrUnsafePath
+	}
+	full := filepath.Join(root, rel)
+	if err := checkSymlinks(root, full); err != nil {
+		return "", "", err
+	}
+	return rel, full, nil
+}
+
+// 解析full中已经存在的部分的符号链接，确认真实路径仍然位于root之下
+// 不存在的部分不可能是符号链接，不需要检查
+func checkSymlinks(root string, full string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// root还没有创建，其中不会有符号链接
+			return nil
+		}
+		return err
+	}
+	// 找到最深的已经存在的部分（包括失效的符号链接）
+	existing := full
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return nil
+		}
+		existing = parent
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		// 失效的符号链接，写入时会在链接指向的位置创建文件
+		return ErrUnsafePath
+	}
+	if !isWithin(realRoot, real) {
+		return ErrUnsafePath
+	}
+	return nil
+}
+
+// path是否为root本身或者位于root之下，两者都需要是清理过的绝对路径
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return filepath.IsLocal(rel)
+}
@@ -0,0 +1,128 @@
+package helpers
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 创建一个照片目录和一个位于照片目录之外的目录
+func setupLibrary(t *testing.T) (string, string) {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "upload", "admin")
+	outside := filepath.Join(base, "config")
+	for _, dir := range []string{filepath.Join(root, "2025", "08"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "master.db"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root, outside
+}
+
+func TestResolvePathRejectsTraversal(t *testing.T) {
+	root, _ := setupLibrary(t)
+	attacks := []string{
+		"..",
+		"../",
+		"../../config/master.db",
+		"../../app/config/master.db",
+		"2025/../../..",
+		"2025/08/../../../admin2/a.jpg",
+		"/../config/master.db",
+		"//../../config/master.db",
+		"./../config",
+		"a.jpg\x00.png",
+		"..\\..\\config\\x.jpg",
+		"\\..\\config\\master.db",
+		"2025\\..\\..\\..",
+	}
+	for _, path := range attacks {
+		if rel, full, err := ResolvePath(root, path); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("ResolvePath(%q) = %q, %q, %v, want ErrUnsafePath", path, rel, full, err)
+		}
+	}
+}
+
+func TestResolvePathCleansAllowedPaths(t *testing.T) {
+	root, _ := setupLibrary(t)
+	cases := map[string]string{
+		"":                    ".",
+		"/":                   ".",
+		"2025/08/a.jpg":       "2025/08/a.jpg",
+		"/2025/08/a.jpg":      "2025/08/a.jpg",
+		"2025/./08//a.jpg":    "2025/08/a.jpg",
+		"2025/08/../07/a.jpg": "2025/07/a.jpg",
+		"new/dir/not/exist":   "new/dir/not/exist",
+		"..a.jpg":             "..a.jpg",
+		"%2e%2e/%2e%2e/etc":   "%2e%2e/%2e%2e/etc",
+		"2025\\08\\a.jpg":     "2025/08/a.jpg",
+		"\\2025\\08\\a.jpg":   "2025/08/a.jpg",
+	}
+	for path, want := range cases {
+		rel, full, err := ResolvePath(root, path)
+		if err != nil {
+			t.Errorf("ResolvePath(%q) error: %v", path, err)
+			continue
+		}
+		if want = filepath.FromSlash(want); rel != want || full != filepath.Join(root, want) {
+			t.Errorf("ResolvePath(%q) = %q, %q, want %q", path, rel, full, want)
+		}
+	}
+}
+
+func TestResolvePathSymlinks(t *testing.T) {
+	root, outside := setupLibrary(t)
+	links := map[string]string{
+		"escape":       outside,
+		"escape.db":    filepath.Join(outside, "master.db"),
+		"dangling.jpg": filepath.Join(outside, "not-exist.jpg"),
+		"inside":       filepath.Join(root, "2025"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("无法创建符号链接: %v", err)
+		}
+	}
+	for _, path := range []string{"escape", "escape/master.db", "escape/new/a.jpg", "escape.db", "dangling.jpg"} {
+		if _, _, err := ResolvePath(root, path); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("ResolvePath(%q) error = %v, want ErrUnsafePath", path, err)
+		}
+	}
+	for _, path := range []string{"inside", "inside/08", "inside/08/new.jpg"} {
+		if _, _, err := ResolvePath(root, path); err != nil {
+			t.Errorf("ResolvePath(%q) error: %v", path, err)
+		}
+	}
+}
+
+func TestResolvePathSymlinkedRoot(t *testing.T) {
+	root, _ := setupLibrary(t)
+	// 照片目录本身是符号链接（如挂载的数据卷）时仍然可以正常访问
+	link := filepath.Join(t.TempDir(), "library")
+	if err := os.Symlink(root, link); err != nil {
+		t.Skipf("无法创建符号链接: %v", err)
+	}
+	if _, _, err := ResolvePath(link, "2025/08/a.jpg"); err != nil {
+		t.Errorf("ResolvePath error: %v", err)
+	}
+	if _, _, err := ResolvePath(link, "../../config/master.db"); !errors.Is(err, ErrUnsafePath) {
+		t.Errorf("ResolvePath error = %v, want ErrUnsafePath", err)
+	}
+}
+
+func TestThumbnailRejectsPathOutsideLibrary(t *testing.T) {
+	root, _ := setupLibrary(t)
+	oldRoot := UPLOAD_ROOT_DIR
+	t.Cleanup(func() { UPLOAD_ROOT_DIR = oldRoot })
+	UPLOAD_ROOT_DIR = filepath.Dir(root)
+	for _, path := range []string{"../config/master.db", "admin/../../config/master.db"} {
+		if _, err := Thumbnail(path, "100x100"); !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("Thumbnail(%q) error = %v, want ErrUnsafePath", path, err)
+		}
+	}
+}
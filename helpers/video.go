@@ -1,12 +1,24 @@
 package helpers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
+var ErrFfprobeMissing = errors.New("ffprobe未安装，无法读取视频元数据")
+
+// ffprobe读取一个视频的超时时间，文件损坏或者位于卡住的网络存储上时避免一直占用元数据读取队列
+const ffprobeTimeout = time.Minute
+
 // ffmpeg转码并发队列
 var transVideoQueue = make(chan struct{}, 3)
 var transVideoOnce sync.Once
@@ -21,6 +33,10 @@ func TransVideo(srcPath string, transExt string) (string, string, error) {
 			transVideoQueue <- struct{}{}
 		}
 	})
+	srcPath, srcFullPath, err := ResolvePath(UPLOAD_ROOT_DIR, srcPath)
+	if err != nil {
+		return "", "", err
+	}
 	// 获取队列令牌
 	<-transVideoQueue
 	defer func() { transVideoQueue <- struct{}{} }()
@@ -29,7 +45,6 @@ func TransVideo(srcPath string, transExt string) (string, string, error) {
 	if FileExists(destFullPath) {
 		return destPath, destFullPath, nil
 	}
-	srcFullPath := filepath.Join(UPLOAD_ROOT_DIR, srcPath)
 	cmd := exec.Command("ffmpeg", "-y", "-i", srcFullPath, "-c:v", "copy", "-c:a", "aac", destFullPath)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -41,9 +56,12 @@ func TransVideo(srcPath string, transExt string) (string, string, error) {
 // ExtractVideoThumbnail 提取视频第一秒画面生成缩略图
 // 先提取图片，再生成缩略图
 func ExtractVideoThumbnail(videoPath string, size string) (string, error) {
+	videoPath, srcFullPath, err := ResolvePath(UPLOAD_ROOT_DIR, videoPath)
+	if err != nil {
+		return "", err
+	}
 	coverFullPath := GetConvertFilename(videoPath, ".jpg")
 	AppLogger.Infof("视频封面路径: %s", coverFullPath)
-	srcFullPath := filepath.Join(UPLOAD_ROOT_DIR, videoPath)
 	if !FileExists(coverFullPath) {
 		// 队列控制ffmpeg并发
 		transVideoOnce.Do(func() {
@@ -63,7 +81,8 @@ func ExtractVideoThumbnail(videoPath string, size string) (string, error) {
 	}
 	// rootDir := filepath.Join(RootDir, "config")
 	// coverPath := strings.TrimPrefix(strings.Replace(coverFullPath, rootDir, "", 1), string(os.PathSeparator))
-	thumbPath, err := Thumbnail(coverFullPath, size)
+	// 封面位于config目录下，不在UPLOAD_ROOT_DIR中，缩略图保存在封面旁边
+	thumbPath, err := thumbnailFile(coverFullPath, fmt.Sprintf("%s_%s.jpg", coverFullPath, size), size)
 	if err != nil {
 		AppLogger.Errorf("生成缩略图 %s 失败: %v", coverFullPath, err)
 		return "", err
@@ -71,3 +90,125 @@ func ExtractVideoThumbnail(videoPath string, size string) (string, error) {
 	AppLogger.Infof("生成缩略图成功: %s => %s", coverFullPath, thumbPath)
 	return thumbPath, nil
 }
+
+// 视频的元数据，从ffprobe的输出中读取
+type VideoMetadata struct {
+	Duration   float64 // 时长，单位秒
+	Width      int     // 视频流存储的宽度，单位像素，Rotation为90或270时显示时需要交换宽高
+	Height     int     // 视频流存储的高度，单位像素
+	Rotation   int     // 显示时需要顺时针旋转的角度：0、90、180、270
+	VideoCodec string  // 视频编码，如 h264、hevc
+	AudioCodec string  // 音频编码，如 aac，没有音频时为空
+	Bitrate    int64   // 总码率，单位bit/s
+	FrameRate  float64 // 帧率
+	CreatedAt  int64   // 拍摄时间，Unix时间戳，单位秒，0表示未知
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType    string            `json:"codec_type"`
+		CodecName    string            `json:"codec_name"`
+		Width        int               `json:"width"`
+		Height       int               `json:"height"`
+		AvgFrameRate string            `json:"avg_frame_rate"`
+		RFrameRate   string            `json:"r_frame_rate"`
+		Tags         map[string]string `json:"tags"`
+		SideDataList []struct {
+			Rotation float64 `json:"rotation"`
+		} `json:"side_data_list"`
+	} `json:"streams"`
+	Format struct {
+		Duration string            `json:"duration"`
+		BitRate  string            `json:"bit_rate"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// 使用ffprobe读取视频的时长、分辨率、旋转角度、编码、码率、帧率和拍摄时间
+func ExtractVideoMetadata(fullPath string) (*VideoMetadata, error) {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return nil, ErrFfprobeMissing
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ffprobeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "quiet", "-print_format", "json", "-show_format", "-show_streams", fullPath)
+	output, err := cmd.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("ffprobe 读取视频信息超时: %v", ctx.Err())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe 读取视频信息失败: %v", err)
+	}
+	var probe ffprobeOutput
+	if err := json.Unmarshal(output, &probe); err != nil {
+		return nil, fmt.Errorf("ffprobe 输出解析失败: %v", err)
+	}
+	meta := &VideoMetadata{}
+	meta.Duration, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	meta.Bitrate, _ = strconv.ParseInt(probe.Format.BitRate, 10, 64)
+	for _, stream := range probe.Streams {
+		switch stream.CodecType {
+		case "video":
+			// 封面图片也是video流，只取第一个视频流
+			if meta.VideoCodec != "" {
+				continue
+			}
+			meta.VideoCodec = stream.CodecName
+			meta.Width = stream.Width
+			meta.Height = stream.Height
+			meta.FrameRate = parseFrameRate(firstNonEmpty(stream.AvgFrameRate, stream.RFrameRate))
+			// 旧版本ffmpeg使用rotate标签（顺时针），新版本使用显示矩阵（逆时针）
+			if rotate, err := strconv.Atoi(stream.Tags["rotate"]); err == nil {
+				meta.Rotation = normalizeRotation(rotate)
+			} else {
+				for _, sd := range stream.SideDataList {
+					if sd.Rotation != 0 {
+						meta.Rotation = normalizeRotation(-int(math.Round(sd.Rotation)))
+						break
+					}
+				}
+			}
+		case "audio":
+			if meta.AudioCodec == "" {
+				meta.AudioCodec = stream.CodecName
+			}
+		}
+	}
+	// 苹果设备拍摄的视频在com.apple.quicktime.creationdate中保存带时区的本地拍摄时间，creation_time是UTC时间
+	meta.CreatedAt = parseVideoTime(probe.Format.Tags["com.apple.quicktime.creationdate"])
+	if meta.CreatedAt == 0 {
+		meta.CreatedAt = parseVideoTime(probe.Format.Tags["creation_time"])
+	}
+	return meta, nil
+}
+
+// 解析帧率，如 30000/1001，0/0表示未知
+func parseFrameRate(value string) float64 {
+	rate := parseRational(value)
+	if math.IsNaN(rate) || math.IsInf(rate, 0) {
+		return 0
+	}
+	return math.Round(rate*1000) / 1000
+}
+
+func normalizeRotation(rotation int) int {
+	return ((rotation % 360) + 360) % 360
+}
+
+// 解析视频中的时间，如 2021-05-06T07:08:09+0800 或 2021-05-06T07:08:09.000000Z
+// 部分设备没有时间时写入1904-01-01（QuickTime的时间起点），当作未知
+func parseVideoTime(value string) int64 {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05-0700", "2006-01-02T15:04:05.999999999-0700", "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			if t.Year() < 1970 {
+				return 0
+			}
+			return t.Unix()
+		}
+	}
+	return 0
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -27,7 +29,10 @@ func main() {
 	getRootDir()
 	logger := helpers.NewLogger("web.log")
 	helpers.AppLogger = helpers.NewLogger("app.log")
+	helpers.AuthLogger = helpers.NewLogger("auth.log")
 	initUploadDir()
+	initQuota()
+	initJwtSecret()
 	helpers.AppLogger.Infof("Backup Server %s (%s) starting...\n", Version, PublishDate)
 	helpers.AppLogger.Infof("运行目录: %s\n", helpers.RootDir)
 	helpers.AppLogger.Infof("上传目录: %s\n", helpers.UPLOAD_ROOT_DIR)
@@ -36,30 +41,100 @@ func main() {
 	helpers.CleanupUploadingFiles() // 清理所有未完成的上传临时文件
 	models.RefreshPhotoCollection() // 先执行一遍
 	models.InitCron()               // 初始化定时任务
+	// 每小时清理过期的上传会话
+	models.GlobalCron.AddFunc("0 * * * *", controllers.CleanupExpiredUploadSessions)
+	// 每天清理过期的刷新Token
+	models.GlobalCron.AddFunc("30 3 * * *", models.DeleteExpiredRefreshTokens)
+	// 每小时清理过期的登录失败记录
+	models.GlobalCron.AddFunc("0 * * * *", controllers.CleanupLoginAttempts)
 	if IsRelease {
 		gin.SetMode(gin.ReleaseMode)
 	}
 	r := gin.New()
 	r.Use(ginlogrus.Logger(logger), gin.Recovery())
 	r.POST("/login", controllers.HandleLogin)
+	r.POST("/refresh", controllers.HandleRefreshToken)
+	// 访问接口需要的权限，由账号的角色决定，使用API Key访问时Key也要拥有该权限
+	uploadScope := controllers.RequireScope(models.ScopeUpload)
+	readScope := controllers.RequireScope(models.ScopeRead)
 	api := r.Group("/api")
 	api.Use(controllers.JWTAuthMiddleware())
 	{
-		api.POST("/exists", controllers.HandleExists)
-		api.POST("/exists-checksum", controllers.HandleChecksumExists)
-		api.POST("/listdir", controllers.HandleListDir)
-		api.POST("/createdir", controllers.HandleCreateDir)
+		api.POST("/exists", uploadScope, controllers.HandleExists)
+		api.POST("/exists-checksum", uploadScope, controllers.HandleChecksumExists)
+		api.POST("/exists-batch", uploadScope, controllers.HandleBatchExists)
+		api.GET("/quota", controllers.HandleQuota)
+		api.POST("/listdir", readScope, controllers.HandleListDir)
+		api.POST("/createdir", uploadScope, controllers.HandleCreateDir)
 	}
 	photoApi := r.Group("/photo")
 	photoApi.Use(controllers.JWTAuthMiddleware())
 	{
-		photoApi.GET("/thumbnail/:path/:size", controllers.HandleGetThumbnail) // 缩略图查看
-		photoApi.GET("/download", controllers.HandlePhotoDownload)             // 文件下载
-		photoApi.GET("/list", controllers.HandlePhotoList)                     // 照片列表
-		photoApi.POST("/update", controllers.HandlePhotoUpdate)                // 照片信息更新
+		photoApi.GET("/thumbnail/:path/:size", readScope, controllers.HandleGetThumbnail) // 缩略图查看
+		photoApi.GET("/download", readScope, controllers.HandlePhotoDownload)             // 文件下载
+		photoApi.GET("/list", readScope, controllers.HandlePhotoList)                     // 照片列表
+		photoApi.POST("/update", uploadScope, controllers.HandlePhotoUpdate)              // 照片信息更新
+	}
+	sessionApi := r.Group("/session")
+	sessionApi.Use(controllers.JWTAuthMiddleware(), controllers.LoginOnlyMiddleware())
+	{
+		sessionApi.GET("/list", controllers.HandleSessionList)             // 登录设备列表
+		sessionApi.POST("/revoke", controllers.HandleSessionRevoke)        // 撤销一个登录设备
+		sessionApi.POST("/revoke-all", controllers.HandleSessionRevokeAll) // 撤销所有登录设备
+	}
+	totpApi := r.Group("/2fa")
+	totpApi.Use(controllers.JWTAuthMiddleware(), controllers.LoginOnlyMiddleware())
+	{
+		totpApi.POST("/enroll", controllers.HandleTotpEnroll)                // 生成两步验证密钥
+		totpApi.POST("/confirm", controllers.HandleTotpConfirm)              // 确认并启用两步验证
+		totpApi.POST("/disable", controllers.HandleTotpDisable)              // 关闭两步验证
+		totpApi.POST("/recovery-codes", controllers.HandleTotpRecoveryCodes) // 重新生成恢复码
+	}
+	apiKeyApi := r.Group("/apikey")
+	apiKeyApi.Use(controllers.JWTAuthMiddleware(), controllers.LoginOnlyMiddleware())
+	{
+		apiKeyApi.GET("/list", controllers.HandleApiKeyList)      // API Key列表
+		apiKeyApi.POST("/create", controllers.HandleApiKeyCreate) // 创建API Key
+		apiKeyApi.POST("/revoke", controllers.HandleApiKeyRevoke) // 撤销API Key
+	}
+	shareApi := r.Group("/share")
+	shareApi.Use(controllers.JWTAuthMiddleware(), readScope)
+	{
+		shareApi.GET("/list", controllers.HandleShareList)      // 分享链接列表
+		shareApi.POST("/create", controllers.HandleShareCreate) // 创建分享链接
+		shareApi.POST("/revoke", controllers.HandleShareRevoke) // 撤销分享链接
+	}
+	// 分享链接的公开访问，不需要登录
+	publicShare := r.Group("/s/:token")
+	{
+		publicShare.GET("", controllers.HandleShareView)                          // 分享的照片列表
+		publicShare.POST("/unlock", controllers.HandleShareUnlock)                // 使用访问密码换取访问凭证
+		publicShare.GET("/thumbnail/:id/:size", controllers.HandleShareThumbnail) // 缩略图
+		publicShare.GET("/download/:id", controllers.HandleShareDownload)         // 下载原图
+	}
+	adminApi := r.Group("/admin")
+	adminApi.Use(controllers.JWTAuthMiddleware(), controllers.AdminMiddleware())
+	{
+		adminApi.GET("/user/list", controllers.HandleUserList)        // 用户列表
+		adminApi.POST("/user/create", controllers.HandleUserCreate)   // 创建用户
+		adminApi.POST("/user/update", controllers.HandleUserUpdate)   // 修改用户
+		adminApi.POST("/user/disable", controllers.HandleUserDisable) // 禁用或启用用户
+		adminApi.POST("/user/delete", controllers.HandleUserDelete)   // 删除用户
+		adminApi.GET("/audit/list", controllers.HandleAuditList)      // 查询审计事件
+		adminApi.GET("/audit/export", controllers.HandleAuditExport)  // 导出审计事件为CSV
 	}
 	r.GET("/upload", controllers.HandleUpload)
-	// r.GET("/upload/status", controllers.HandleUploadStatus)
+	// 基于HTTP的断点续传上传，兼容tus协议
+	r.OPTIONS("/files", controllers.HandleTusOptions)
+	tusApi := r.Group("/files")
+	tusApi.Use(controllers.JWTAuthMiddleware(), uploadScope)
+	{
+		tusApi.POST("", controllers.HandleTusCreate)       // 创建上传
+		tusApi.HEAD("/:id", controllers.HandleTusHead)     // 查询偏移量
+		tusApi.PATCH("/:id", controllers.HandleTusPatch)   // 上传数据
+		tusApi.DELETE("/:id", controllers.HandleTusDelete) // 终止上传
+	}
+	r.GET("/upload/status", controllers.JWTAuthMiddleware(), uploadScope, controllers.HandleUploadStatus) // 上传状态
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "12334"
@@ -95,6 +170,45 @@ func initUploadDir() {
 	}
 }
 
+func initQuota() {
+	// 存储配额，如 500G，不设置则不限制
+	var err error
+	if helpers.GlobalQuota, err = helpers.ParseSize(os.Getenv("STORAGE_QUOTA")); err != nil {
+		helpers.AppLogger.Errorf("STORAGE_QUOTA 配置错误，不限制存储空间: %v", err)
+	}
+	if helpers.UserQuota, err = helpers.ParseSize(os.Getenv("USER_QUOTA")); err != nil {
+		helpers.AppLogger.Errorf("USER_QUOTA 配置错误，不限制存储空间: %v", err)
+	}
+	helpers.AppLogger.Infof("存储配额: 全局 %d 字节, 每个账号 %d 字节 (0表示不限制)", helpers.GlobalQuota, helpers.UserQuota)
+}
+
+// JWT签名密钥：优先使用JWT_SECRET环境变量，否则读取config/jwt.secret，文件不存在时随机生成并保存
+func initJwtSecret() {
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		helpers.JwtSecret = []byte(secret)
+		return
+	}
+	secretFile := filepath.Join(helpers.RootDir, "config", "jwt.secret")
+	if data, err := os.ReadFile(secretFile); err == nil {
+		if secret := strings.TrimSpace(string(data)); secret != "" {
+			helpers.JwtSecret = []byte(secret)
+			return
+		}
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("生成JWT密钥失败: %v", err))
+	}
+	secret := hex.EncodeToString(b)
+	os.MkdirAll(filepath.Dir(secretFile), 0755)
+	if err := os.WriteFile(secretFile, []byte(secret), 0600); err != nil {
+		helpers.AppLogger.Errorf("保存JWT密钥失败，重启后已签发的Token将失效: %v", err)
+	} else {
+		helpers.AppLogger.Infof("已生成新的JWT密钥: %s", secretFile)
+	}
+	helpers.JwtSecret = []byte(secret)
+}
+
 func checkRelease() {
 	arg1 := strings.ToLower(os.Args[0])
 	fmt.Printf("arg1=%s\n", arg1)
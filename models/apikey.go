@@ -0,0 +1,124 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+	"gorm.io/gorm"
+)
+
+// API Key的前缀，用来和JWT区分
+const ApiKeyPrefix = "bk_"
+
+var ErrApiKeyInvalid = errors.New("API Key无效、已过期或已被撤销")
+
+// 最后使用时间的更新间隔，避免每个请求都写数据库
+const apiKeyTouchInterval = time.Minute
+
+// 给脚本和自动化工具使用的长期凭证，数据库中只保存哈希值
+type ApiKey struct {
+	BaseModel
+	UserId    uint   `json:"user_id" gorm:"index"` // API Key所属的用户，使用该用户的照片目录
+	Name      string `json:"name"`                 // 名称，方便区分用途
+	Prefix    string `json:"prefix"`               // API Key的前几位，用来识别是哪个Key
+	KeyHash   string `json:"-" gorm:"uniqueIndex"` // API Key的SHA256
+	Scopes    string `json:"scopes"`               // 权限范围，逗号分隔，如 upload,read
+	ExpiresAt int64  `json:"expires_at"`           // 过期时间，Unix时间戳，单位秒，0表示永不过期
+	Revoked   bool   `json:"revoked"`              // 是否已撤销
+	LastUsed  int64  `json:"last_used"`            // 最后使用时间，Unix时间戳，单位秒
+}
+
+// 是否拥有某个权限，admin包含所有权限
+func (k *ApiKey) HasScope(scope string) bool {
+	scopes := strings.Split(k.Scopes, ",")
+	return slices.Contains(scopes, ScopeAdmin) || slices.Contains(scopes, scope)
+}
+
+// 更新最后使用时间，距离上次更新不足apiKeyTouchInterval时跳过
+func (k *ApiKey) Touch() {
+	now := time.Now().Unix()
+	if now-k.LastUsed < int64(apiKeyTouchInterval.Seconds()) {
+		return
+	}
+	k.LastUsed = now
+	id := k.ID
+	helpers.EnqueueDBWrite(func(db *gorm.DB) error {
+		return db.Model(&ApiKey{}).Where("id = ?", id).Update("last_used", now).Error
+	})
+}
+
+// 创建API Key，返回记录和Key的明文，明文只在创建时返回一次
+func CreateApiKey(userId uint, name string, scopes []string, expiresAt int64) (*ApiKey, string, error) {
+	if len(scopes) == 0 {
+		return nil, "", fmt.Errorf("至少需要一个权限")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return nil, "", fmt.Errorf("不支持的权限: %s", scope)
+		}
+	}
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	key := ApiKeyPrefix + hex.EncodeToString(b)
+	apiKey := ApiKey{
+		UserId:    userId,
+		Name:      name,
+		Prefix:    key[:len(ApiKeyPrefix)+6],
+		KeyHash:   helpers.BytesSHA256([]byte(key)),
+		Scopes:    strings.Join(scopes, ","),
+		ExpiresAt: expiresAt,
+	}
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Create(&apiKey).Error
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &apiKey, key, nil
+}
+
+// 校验API Key，返回对应的记录
+func GetApiKeyByKey(key string) (*ApiKey, error) {
+	var apiKey ApiKey
+	if err := helpers.Db.Where("key_hash = ?", helpers.BytesSHA256([]byte(key))).First(&apiKey).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrApiKeyInvalid
+		}
+		return nil, err
+	}
+	if apiKey.Revoked || (apiKey.ExpiresAt > 0 && apiKey.ExpiresAt < time.Now().Unix()) {
+		return nil, ErrApiKeyInvalid
+	}
+	return &apiKey, nil
+}
+
+// 查询用户的所有API Key
+func ListApiKeys(userId uint) ([]*ApiKey, error) {
+	keys := make([]*ApiKey, 0)
+	if err := helpers.Db.Where("user_id = ?", userId).Order("id DESC").Find(&keys).Error; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// 撤销用户的API Key，撤销后立即失效，记录保留
+func RevokeApiKey(userId uint, id uint) error {
+	return helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		result := db.Model(&ApiKey{}).Where("id = ? AND user_id = ?", id, userId).Update("revoked", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
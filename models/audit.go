@@ -0,0 +1,120 @@
+package models
+
+import (
+	"github.com/qicfan/backup-server/helpers"
+	"gorm.io/gorm"
+)
+
+// 审计事件的类型
+const (
+	AuditLogin         = "login"          // 登录成功
+	AuditLoginFailed   = "login_failed"   // 登录失败，包括密码错误、两步验证码错误、被限制和被禁用
+	AuditTokenRefresh  = "token_refresh"  // 使用刷新Token换取新的Token
+	AuditSessionRevoke = "session_revoke" // 撤销登录设备
+	AuditApiKeyCreate  = "apikey_create"  // 创建API Key
+	AuditApiKeyRevoke  = "apikey_revoke"  // 撤销API Key
+	AuditTotpEnable    = "totp_enable"    // 启用两步验证
+	AuditTotpDisable   = "totp_disable"   // 关闭两步验证
+	AuditUpload        = "upload"         // 上传文件，失败或被终止的上传也会记录
+	AuditCreateDir     = "create_dir"     // 创建目录
+	AuditPhotoUpdate   = "photo_update"   // 更新照片信息
+	AuditShareCreate   = "share_create"   // 创建分享链接
+	AuditShareRevoke   = "share_revoke"   // 撤销分享链接
+	AuditUserCreate    = "user_create"    // 创建用户
+	AuditUserUpdate    = "user_update"    // 修改用户的密码、角色、配额或重置两步验证
+	AuditUserDisable   = "user_disable"   // 禁用或启用用户
+	AuditUserDelete    = "user_delete"    // 删除用户
+)
+
+// 审计事件，记录登录、签发Token、上传、删除、创建目录、修改照片和账号配置等操作
+type AuditEvent struct {
+	BaseModel
+	UserId   uint             `json:"user_id" gorm:"index"` // 操作者，登录失败时可能为0
+	Username string           `json:"username" gorm:"index"`
+	Action   string           `json:"action" gorm:"index"` // 事件类型，见AuditXxx常量
+	Target   string           `json:"target"`              // 操作对象，如文件路径、用户名、API Key前缀
+	IP       string           `json:"ip"`
+	ClientOS helpers.ClientOS `json:"client_os"`
+	Success  bool             `json:"success"`
+	Detail   string           `json:"detail"` // 补充信息，如失败原因
+}
+
+// 审计事件的查询条件，零值表示不限制
+type AuditFilter struct {
+	UserId   uint
+	Username string
+	Action   string
+	IP       string
+	Target   string // 按前缀匹配
+	Success  *bool
+	From     int64 // 开始时间，Unix时间戳，单位秒
+	To       int64 // 结束时间，Unix时间戳，单位秒
+}
+
+func (f AuditFilter) apply(db *gorm.DB) *gorm.DB {
+	if f.UserId > 0 {
+		db = db.Where("user_id = ?", f.UserId)
+	}
+	if f.Username != "" {
+		db = db.Where("username = ?", f.Username)
+	}
+	if f.Action != "" {
+		db = db.Where("action = ?", f.Action)
+	}
+	if f.IP != "" {
+		db = db.Where("ip = ?", f.IP)
+	}
+	if f.Target != "" {
+		db = db.Where("target LIKE ? ESCAPE '\\'", escapeLike(f.Target)+"%")
+	}
+	if f.Success != nil {
+		db = db.Where("success = ?", *f.Success)
+	}
+	if f.From > 0 {
+		db = db.Where("created_at >= ?", f.From)
+	}
+	if f.To > 0 {
+		db = db.Where("created_at <= ?", f.To)
+	}
+	return db
+}
+
+// 转义LIKE中的通配符
+func escapeLike(s string) string {
+	r := make([]rune, 0, len(s))
+	for _, c := range s {
+		if c == '%' || c == '_' || c == '\\' {
+			r = append(r, '\\')
+		}
+		r = append(r, c)
+	}
+	return string(r)
+}
+
+// 记录一个审计事件，异步写入数据库
+func RecordAuditEvent(event AuditEvent) {
+	helpers.EnqueueDBWrite(func(db *gorm.DB) error {
+		return db.Create(&event).Error
+	})
+}
+
+// 分页查询审计事件，按时间倒序
+func ListAuditEvents(filter AuditFilter, page int, pageSize int) (int64, []*AuditEvent, error) {
+	events := make([]*AuditEvent, 0)
+	var total int64
+	if err := filter.apply(helpers.Db.Model(&AuditEvent{})).Count(&total).Error; err != nil {
+		return 0, nil, err
+	}
+	if err := filter.apply(helpers.Db).Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&events).Error; err != nil {
+		return 0, nil, err
+	}
+	return total, events, nil
+}
+
+// 按时间顺序分批读取符合条件的审计事件，用于导出
+func EachAuditEvent(filter AuditFilter, batchSize int, fn func(events []*AuditEvent) error) error {
+	var events []*AuditEvent
+	return filter.apply(helpers.Db).Order("id ASC").FindInBatches(&events, batchSize, func(tx *gorm.DB, batch int) error {
+		return fn(events)
+	}).Error
+}
@@ -23,25 +23,54 @@ func RefreshPhotoCollection() {
 	defer func() {
 		refreshPhotoCollectionLock = false
 	}()
-	// 查询数据库中的所有数据
+	// 每个用户有自己的照片目录，分别扫描
+	users, err := ListUsers()
+	if err != nil {
+		helpers.AppLogger.Errorf("查询用户列表失败: %v", err)
+		return
+	}
+	for _, user := range users {
+		refreshUserPhotos(user)
+	}
+	// 在后台补全新照片和旧照片的拍摄时间等元数据
+	RefreshPhotosMetadataAsync()
+	helpers.AppLogger.Infof("扫描本地文件任务 执行完成")
+}
+
+// 扫描用户的照片目录
+func refreshUserPhotos(user *User) {
+	rootDir := user.RootDir()
+	// 查询数据库中该用户的所有数据
 	// 生成路径到ID的映射
 	// 如果本地存在则跳过，否则插入，然后删除映射关系
 	// 最后留在映射关系中的记录就是数据库中存在但本地不存在的，删除这些记录
 	dbPathMap := make(map[string]string)
+	// 还没有PreChecksum的照片，扫描时补全
+	missingPreChecksum := make(map[string]uint)
 	photos := make([]Photo, 0)
-	helpers.Db.Select("id", "path", "checksum").Find(&photos)
+	helpers.Db.Select("id", "path", "checksum", "pre_checksum").Where("user_id = ?", user.ID).Find(&photos)
 	for _, p := range photos {
 		dbPathMap[p.Path] = p.Checksum
+		if p.PreChecksum == "" {
+			missingPreChecksum[p.Path] = p.ID
+		}
 	}
-	filepath.Walk(helpers.UPLOAD_ROOT_DIR, func(path string, info os.FileInfo, err error) error {
+	filepath.Walk(rootDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info.IsDir() {
 			return nil
 		}
-		relPath := strings.TrimPrefix(strings.TrimPrefix(path, helpers.UPLOAD_ROOT_DIR), string(os.PathSeparator))
+		relPath := strings.TrimPrefix(strings.TrimPrefix(path, rootDir), string(os.PathSeparator))
 		// 检查是否在数据库中存在
 		if _, exists := dbPathMap[relPath]; exists {
 			// 存在，跳过
 			delete(dbPathMap, relPath)
+			if id, ok := missingPreChecksum[relPath]; ok {
+				if preChecksum, err := helpers.FileHeadSHA1(path); err == nil {
+					helpers.EnqueueDBWrite(func(db *gorm.DB) error {
+						return db.Model(&Photo{}).Where("id = ?", id).Update("pre_checksum", preChecksum).Error
+					})
+				}
+			}
 			return nil
 		}
 		name := info.Name()
@@ -52,7 +81,7 @@ func RefreshPhotoCollection() {
 		ext := filepath.Ext(name)
 		baseName := strings.TrimSuffix(path, ext)
 		ext = strings.ToLower(ext)
-		if ext == ".chunk" {
+		if ext == ".chunk" || ext == helpers.UploadingExt {
 			return nil
 		}
 		needProcess := false
@@ -65,7 +94,7 @@ func RefreshPhotoCollection() {
 				livePhotoVideoFullPath = baseName + e
 				if helpers.FileExists(livePhotoVideoFullPath) {
 					photoType = PhotoTypeLivePhoto
-					livePhotoVideoPath = strings.TrimPrefix(strings.TrimPrefix(livePhotoVideoFullPath, helpers.UPLOAD_ROOT_DIR), string(os.PathSeparator))
+					livePhotoVideoPath = strings.TrimPrefix(strings.TrimPrefix(livePhotoVideoFullPath, rootDir), string(os.PathSeparator))
 					break
 				}
 			}
@@ -88,17 +117,18 @@ func RefreshPhotoCollection() {
 			return nil
 		}
 		// 查询数据库是否存在
-		photo, photoGetErr := GetPhotoByPath(relPath)
+		photo, photoGetErr := GetPhotoByPath(user.ID, relPath)
 		if photoGetErr != nil && photoGetErr == gorm.ErrRecordNotFound {
 			// 读取文件的修改时间
 			checksum, _ := helpers.FileSHA1(path)
 			// 检查checksum是否存在
-			if exists, _ := CheckPhotoChecksum(checksum); exists {
+			if exists, _ := CheckPhotoChecksum(user.ID, checksum); exists {
 				// helpers.AppLogger.Infof("Checksum exists，跳过:%s => %s", relPath, checksum)
 				return nil
 			}
+			preChecksum, _ := helpers.FileHeadSHA1(path)
 			modificationTime := info.ModTime().Unix()
-			if insertErr := InsertPhoto(name, relPath, info.Size(), photoType, livePhotoVideoPath, "", modificationTime, modificationTime, checksum, 0); insertErr != nil {
+			if insertErr := InsertPhoto(user.ID, name, relPath, info.Size(), photoType, livePhotoVideoPath, "", modificationTime, modificationTime, checksum, preChecksum, 0); insertErr != nil {
 				helpers.AppLogger.Error("插入数据库失败: ", insertErr)
 			}
 			return nil
@@ -124,10 +154,9 @@ func RefreshPhotoCollection() {
 	for p, checksum := range dbPathMap {
 		helpers.AppLogger.Infof("删除数据库中多余的记录: %s => %s", p, checksum)
 		helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
-			return db.Where("path = ?", p).Delete(&Photo{}).Error
+			return db.Where("user_id = ? AND path = ?", user.ID, p).Delete(&Photo{}).Error
 		})
 	}
-	helpers.AppLogger.Infof("扫描本地文件任务 执行完成")
 }
 
 // 初始化定时任务
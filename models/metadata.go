@@ -0,0 +1,157 @@
+package models
+
+import (
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+	"gorm.io/gorm"
+)
+
+// 读取元数据的并发数，上传完成后的读取和后台补全共享，identify需要解码图片，ffprobe需要读取视频，避免同时运行太多
+var metadataQueue = make(chan struct{}, 2)
+
+// 读取照片文件的元数据并保存：图片读取EXIF/XMP，视频使用ffprobe读取，动态照片的图片同时读取其中视频的元数据
+// 没有拍摄时间的照片使用修改时间作为拍摄时间
+func (p *Photo) RefreshMetadata() error {
+	fullPath := p.FullPath()
+	if helpers.IsImage(fullPath) {
+		meta, err := helpers.ExtractImageMetadata(fullPath)
+		if err != nil {
+			return err
+		}
+		p.TakenAt = meta.TakenAt
+		p.CameraMake = meta.CameraMake
+		p.CameraModel = meta.CameraModel
+		p.LensModel = meta.LensModel
+		p.ExposureTime = meta.ExposureTime
+		p.FNumber = meta.FNumber
+		p.ISO = meta.ISO
+		p.FocalLength = meta.FocalLength
+		p.Orientation = meta.Orientation
+		p.Width = meta.Width
+		p.Height = meta.Height
+		p.Latitude = meta.Latitude
+		p.Longitude = meta.Longitude
+	}
+	if videoPath := p.videoFullPath(); videoPath != "" {
+		meta, err := helpers.ExtractVideoMetadata(videoPath)
+		if errors.Is(err, helpers.ErrFfprobeMissing) {
+			return err
+		}
+		if err != nil {
+			// 文件损坏等错误重试也不会成功，仍然标记为已读取
+			helpers.AppLogger.Warnf("读取视频 %s 的元数据失败: %v", videoPath, err)
+			meta = &helpers.VideoMetadata{}
+		}
+		p.Duration = meta.Duration
+		p.Rotation = meta.Rotation
+		p.VideoCodec = meta.VideoCodec
+		p.AudioCodec = meta.AudioCodec
+		p.Bitrate = meta.Bitrate
+		p.FrameRate = meta.FrameRate
+		if videoPath == fullPath {
+			p.Width = meta.Width
+			p.Height = meta.Height
+			p.TakenAt = meta.CreatedAt
+		}
+	}
+	if p.TakenAt == 0 {
+		p.TakenAt = p.MTime
+	}
+	p.MetadataAt = time.Now().Unix()
+	return helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Model(p).Select("taken_at", "camera_make", "camera_model", "lens_model", "exposure_time", "f_number", "iso", "focal_length", "orientation", "width", "height", "latitude", "longitude",
+			"duration", "rotation", "video_codec", "audio_codec", "bitrate", "frame_rate", "metadata_at").Updates(p).Error
+	})
+}
+
+// 需要使用ffprobe读取的视频文件：视频本身或者动态照片中的视频，没有则返回空字符串
+func (p *Photo) videoFullPath() string {
+	fullPath := p.FullPath()
+	if helpers.IsVideo(fullPath) {
+		return fullPath
+	}
+	if p.LivePhotoVideoPath != "" {
+		return filepath.Join(UserRootDir(p.UserId), p.LivePhotoVideoPath)
+	}
+	return ""
+}
+
+// 上传完成后在后台读取照片的元数据，失败的照片由扫描任务重试
+func RefreshPhotoMetadataAsync(userId uint, path string) {
+	go func() {
+		metadataQueue <- struct{}{}
+		defer func() { <-metadataQueue }()
+		photo, err := GetPhotoByPath(userId, path)
+		if err != nil {
+			helpers.AppLogger.Errorf("查询照片 %s 失败: %v", path, err)
+			return
+		}
+		if err := photo.RefreshMetadata(); err != nil {
+			helpers.AppLogger.Warnf("读取照片 %s 的元数据失败: %v", path, err)
+		}
+	}()
+}
+
+// 每批读取元数据的照片数
+const metadataBatchSize = 200
+
+// 是否正在补全元数据，同一时间只运行一个补全任务
+var refreshMetadataRunning atomic.Bool
+
+// 在后台补全所有还没有元数据的照片，由扫描任务调用，不阻塞扫描和服务启动
+// 按ID分批查询，每张照片都需要先获取metadataQueue令牌，与上传完成后的读取共享并发数
+func RefreshPhotosMetadataAsync() {
+	if !refreshMetadataRunning.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer refreshMetadataRunning.Store(false)
+		refreshPhotosMetadata()
+	}()
+}
+
+func refreshPhotosMetadata() {
+	// 缺少ImageMagick或ffprobe时跳过需要该工具的照片，等待下次扫描
+	missing := make(map[error]bool)
+	var lastId uint
+	count := 0
+	for {
+		photos := make([]*Photo, 0, metadataBatchSize)
+		if err := helpers.Db.Where("metadata_at = ? AND id > ?", 0, lastId).Order("id ASC").Limit(metadataBatchSize).Find(&photos).Error; err != nil {
+			helpers.AppLogger.Errorf("查询待读取元数据的照片失败: %v", err)
+			return
+		}
+		if len(photos) == 0 {
+			break
+		}
+		lastId = photos[len(photos)-1].ID
+		for _, photo := range photos {
+			if missing[helpers.ErrFfprobeMissing] && photo.videoFullPath() != "" {
+				continue
+			}
+			if missing[helpers.ErrMetadataToolMissing] && helpers.IsImage(photo.FullPath()) {
+				continue
+			}
+			metadataQueue <- struct{}{}
+			err := photo.RefreshMetadata()
+			<-metadataQueue
+			if err != nil {
+				if errors.Is(err, helpers.ErrMetadataToolMissing) || errors.Is(err, helpers.ErrFfprobeMissing) {
+					helpers.AppLogger.Warnf("无法读取照片元数据: %v", err)
+					missing[err] = true
+					continue
+				}
+				helpers.AppLogger.Warnf("读取照片 %s 的元数据失败: %v", photo.Path, err)
+				continue
+			}
+			count++
+		}
+	}
+	if count > 0 {
+		helpers.AppLogger.Infof("补全了 %d 张照片的元数据", count)
+	}
+}
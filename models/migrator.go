@@ -1,7 +1,11 @@
 package models
 
 import (
+	"os"
+	"path/filepath"
+
 	"github.com/qicfan/backup-server/helpers"
+	"gorm.io/gorm"
 )
 
 type Migrator struct {
@@ -45,6 +49,161 @@ func Migrate() {
 		helpers.Db.Model(&Photo{}).Where("id > ?", 0).Update("source_id", 0)
 		migrator.updateVersion()
 	}
+	if migrator.VersionCode == 4 {
+		// file_uri增加索引，用于批量查询
+		helpers.Db.AutoMigrate(Photo{})
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 5 {
+		// 增加pre_checksum字段，已有照片由扫描任务补全
+		helpers.Db.AutoMigrate(Photo{})
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 6 {
+		// 增加用户表，使用USERNAME和PASSWORD环境变量创建第一个管理员
+		helpers.Db.AutoMigrate(User{})
+		createDefaultAdmin()
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 7 {
+		// 照片按用户隔离：增加user_id字段，path和checksum改为在用户内唯一
+		// 已有的照片归属第一个管理员，并移动到管理员的照片目录中
+		helpers.Db.AutoMigrate(Photo{})
+		for _, name := range []string{"uni_photos_path", "uni_photos_checksum"} {
+			if !helpers.Db.Migrator().HasConstraint(&Photo{}, name) {
+				continue
+			}
+			if err := helpers.Db.Migrator().DropConstraint(&Photo{}, name); err != nil {
+				helpers.AppLogger.Errorf("删除约束 %s 失败：%v", name, err)
+			}
+		}
+		helpers.Db.Model(&Photo{}).Where("user_id IS NULL OR user_id = ?", 0).Update("user_id", 1)
+		moveLegacyPhotos()
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 8 {
+		// 增加刷新Token表
+		helpers.Db.AutoMigrate(RefreshToken{})
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 9 {
+		// 增加设备会话表，刷新Token关联到会话，之前签发的刷新Token没有会话，需要重新登录
+		helpers.Db.AutoMigrate(DeviceSession{}, RefreshToken{})
+		helpers.Db.Where("session_id IS NULL OR session_id = ?", 0).Delete(&RefreshToken{})
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 10 {
+		// 两步验证：用户表增加TOTP字段，增加恢复码表
+		helpers.Db.AutoMigrate(User{}, RecoveryCode{})
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 11 {
+		// 增加API Key表
+		helpers.Db.AutoMigrate(ApiKey{})
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 12 {
+		// 用户增加角色字段，替代is_admin：管理员为admin，其他用户为member
+		helpers.Db.AutoMigrate(User{})
+		if helpers.Db.Migrator().HasColumn(&User{}, "is_admin") {
+			helpers.Db.Model(&User{}).Where("is_admin = ?", true).Update("role", RoleAdmin)
+			helpers.Db.Migrator().DropColumn(&User{}, "is_admin")
+		}
+		helpers.Db.Model(&User{}).Where("role IS NULL OR role = ?", "").Update("role", RoleMember)
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 13 {
+		// 增加照片分享链接
+		helpers.Db.AutoMigrate(ShareLink{})
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 14 {
+		// 增加审计事件
+		helpers.Db.AutoMigrate(AuditEvent{})
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 15 {
+		// 照片增加拍摄时间、相机、镜头、尺寸和位置等元数据，元数据由扫描任务读取
+		// 读取之前拍摄时间先使用修改时间
+		helpers.Db.AutoMigrate(Photo{})
+		helpers.Db.Model(&Photo{}).Where("taken_at IS NULL OR taken_at = ?", 0).Update("taken_at", gorm.Expr("m_time"))
+		helpers.Db.Model(&Photo{}).Where("metadata_at IS NULL").Update("metadata_at", 0)
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 16 {
+		// 照片增加视频时长、旋转角度、编码、码率和帧率，视频和动态照片需要重新读取元数据
+		helpers.Db.AutoMigrate(Photo{})
+		helpers.Db.Model(&Photo{}).Where("type IN ?", []PhotoType{PhotoTypeVideo, PhotoTypeLivePhoto}).Update("metadata_at", 0)
+		migrator.updateVersion()
+	}
+	if migrator.VersionCode == 17 {
+		// 用户名是照片目录的名称，增加不区分大小写的唯一索引，避免在不区分大小写的文件系统上两个用户共用一个目录
+		if err := helpers.Db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_users_username_nocase ON users (username COLLATE NOCASE)").Error; err != nil {
+			helpers.AppLogger.Errorf("创建用户名唯一索引失败，已有仅大小写不同的用户名：%v", err)
+		}
+		migrator.updateVersion()
+	}
+}
+
+// 使用USERNAME和PASSWORD环境变量（默认admin/admin）创建第一个管理员，ID为1
+func createDefaultAdmin() {
+	username := os.Getenv("USERNAME")
+	if username == "" {
+		username = "admin"
+	}
+	password := os.Getenv("PASSWORD")
+	if password == "" {
+		password = "admin"
+	}
+	admin := User{BaseModel: BaseModel{ID: 1}, Username: username, Role: RoleAdmin}
+	if err := admin.SetPassword(password); err != nil {
+		helpers.AppLogger.Errorf("创建管理员失败：%v", err)
+		return
+	}
+	if err := helpers.Db.Create(&admin).Error; err != nil {
+		helpers.AppLogger.Errorf("创建管理员失败：%v", err)
+		return
+	}
+	helpers.AppLogger.Infof("创建管理员 %s 成功", username)
+}
+
+// 将上传根目录下已有的文件移动到第一个管理员的照片目录，照片的相对路径保持不变
+func moveLegacyPhotos() {
+	admin, err := GetUserById(1)
+	if err != nil {
+		helpers.AppLogger.Errorf("查询管理员失败，无法移动已有的照片：%v", err)
+		return
+	}
+	users, err := ListUsers()
+	if err != nil {
+		helpers.AppLogger.Errorf("查询用户列表失败，无法移动已有的照片：%v", err)
+		return
+	}
+	userDirs := make(map[string]bool)
+	for _, u := range users {
+		userDirs[u.LibraryDir()] = true
+	}
+	entries, err := os.ReadDir(helpers.UPLOAD_ROOT_DIR)
+	if err != nil {
+		helpers.AppLogger.Errorf("读取上传目录失败，无法移动已有的照片：%v", err)
+		return
+	}
+	if err := os.MkdirAll(admin.RootDir(), 0755); err != nil {
+		helpers.AppLogger.Errorf("创建管理员照片目录失败：%v", err)
+		return
+	}
+	for _, entry := range entries {
+		if userDirs[entry.Name()] {
+			continue
+		}
+		src := filepath.Join(helpers.UPLOAD_ROOT_DIR, entry.Name())
+		dst := filepath.Join(admin.RootDir(), entry.Name())
+		if err := os.Rename(src, dst); err != nil {
+			helpers.AppLogger.Errorf("移动 %s 到 %s 失败：%v", src, dst, err)
+			continue
+		}
+		helpers.AppLogger.Infof("移动 %s 到 %s", src, dst)
+	}
 }
 
 func (m *Migrator) updateVersion() {
@@ -1,9 +1,13 @@
 package models
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -21,21 +25,48 @@ const (
 
 type Photo struct {
 	BaseModel
-	Name               string    `json:"name"`                   // 照片名称，文件名：a.jpg / b.mp4
-	Path               string    `json:"path" gorm:"unique"`     // 照片存储路径，包含照片名称，相对helpers.UPLOAD_ROOT_DIR的路径
-	Size               int64     `json:"size"`                   // 照片大小
-	Type               PhotoType `json:"type"`                   // 照片类型，1-普通照片，2-视频， 3-动态照片
-	LivePhotoVideoPath string    `json:"live_photo_video_path"`  // 如果是动态照片，这里存储视频的路径，只有动态照片中的图片会保存该字段，如果是动态照片的视频则该字段为空
-	FileURI            string    `json:"fileUri"`                // 鸿蒙系统的照片资源的URI，可以用来查询照片是否存在，如果有这个字段代表本地存在该照片
-	MTime              int64     `json:"mtime"`                  // 照片的最后修改时间，Unix时间戳，单位秒
-	CTime              int64     `json:"ctime"`                  // 照片的创建时间，Unix时间戳，单位秒
-	Checksum           string    `json:"checksum" gorm:"unique"` // 照片的SHA1哈希值，用来判定照片的唯一性
-	SourceId           uint      `json:"source_id"`              // 照片的来源ID，转码前的原图ID
+	UserId             uint      `json:"user_id" gorm:"uniqueIndex:idx_photos_user_path;uniqueIndex:idx_photos_user_checksum"` // 照片所属的用户
+	Name               string    `json:"name"`                                                                                 // 照片名称，文件名：a.jpg / b.mp4
+	Path               string    `json:"path" gorm:"uniqueIndex:idx_photos_user_path"`                                         // 照片存储路径，包含照片名称，相对用户照片目录（见User.RootDir）的路径
+	Size               int64     `json:"size"`                                                                                 // 照片大小
+	Type               PhotoType `json:"type"`                                                                                 // 照片类型，1-普通照片，2-视频， 3-动态照片
+	LivePhotoVideoPath string    `json:"live_photo_video_path"`                                                                // 如果是动态照片，这里存储视频的路径，只有动态照片中的图片会保存该字段，如果是动态照片的视频则该字段为空
+	FileURI            string    `json:"fileUri" gorm:"index"`                                                                 // 鸿蒙系统的照片资源的URI，可以用来查询照片是否存在，如果有这个字段代表本地存在该照片
+	MTime              int64     `json:"mtime"`                                                                                // 照片的最后修改时间，Unix时间戳，单位秒
+	CTime              int64     `json:"ctime"`                                                                                // 照片的创建时间，Unix时间戳，单位秒
+	Checksum           string    `json:"checksum" gorm:"uniqueIndex:idx_photos_user_checksum"`                                 // 照片的SHA1哈希值，用来判定照片在用户照片库中的唯一性
+	PreChecksum        string    `json:"pre_checksum" gorm:"index"`                                                            // 照片64kb到65kb的SHA1（见helpers.FileHeadSHA1），配合大小快速判断可能重复的照片
+	SourceId           uint      `json:"source_id"`                                                                            // 照片的来源ID，转码前的原图ID
+	TakenAt            int64     `json:"taken_at" gorm:"index"`                                                                // 拍摄时间，Unix时间戳，单位秒，没有拍摄时间的照片使用MTime，时间线按该字段排序
+	CameraMake         string    `json:"camera_make" gorm:"index"`                                                             // 相机厂商
+	CameraModel        string    `json:"camera_model" gorm:"index"`                                                            // 相机型号
+	LensModel          string    `json:"lens_model"`                                                                           // 镜头型号
+	ExposureTime       string    `json:"exposure_time"`                                                                        // 曝光时间，如 1/120
+	FNumber            float64   `json:"f_number"`                                                                             // 光圈值
+	ISO                int       `json:"iso"`                                                                                  // 感光度
+	FocalLength        float64   `json:"focal_length"`                                                                         // 焦距，单位毫米
+	Orientation        int       `json:"orientation"`                                                                          // EXIF方向，1-8，0表示未知
+	Width              int       `json:"width"`                                                                                // 宽度，单位像素，视频为视频流存储的宽度
+	Height             int       `json:"height"`                                                                               // 高度，单位像素
+	Latitude           *float64  `json:"latitude" gorm:"index"`                                                                // 拍摄地点的纬度，没有位置信息时为null
+	Longitude          *float64  `json:"longitude"`                                                                            // 拍摄地点的经度
+	Duration           float64   `json:"duration"`                                                                             // 视频时长，单位秒，动态照片为其中视频的时长
+	Rotation           int       `json:"rotation"`                                                                             // 视频显示时需要顺时针旋转的角度：0、90、180、270
+	VideoCodec         string    `json:"video_codec"`                                                                          // 视频编码，如 h264、hevc
+	AudioCodec         string    `json:"audio_codec"`                                                                          // 音频编码，如 aac，没有音频时为空
+	Bitrate            int64     `json:"bitrate"`                                                                              // 视频码率，单位bit/s
+	FrameRate          float64   `json:"frame_rate"`                                                                           // 视频帧率
+	MetadataAt         int64     `json:"metadata_at" gorm:"index"`                                                             // 读取元数据的时间，0表示还没有读取，由上传完成和扫描任务补全
 }
 
 // 返回绝对路径
 func (p *Photo) FullPath() string {
-	return filepath.Join(helpers.UPLOAD_ROOT_DIR, p.Path)
+	return filepath.Join(UserRootDir(p.UserId), p.Path)
+}
+
+// 返回相对helpers.UPLOAD_ROOT_DIR的路径，缩略图、转码等helpers函数使用该路径
+func (p *Photo) LibraryPath() string {
+	return filepath.Join(UserDir(p.UserId), p.Path)
 }
 
 // 更新照片信息
@@ -46,7 +77,7 @@ func (p *Photo) Update() error {
 }
 
 // 插入一张照片
-func InsertPhoto(name string, path string, size int64, photoType PhotoType, livePhotoVideoPath string, fileUri string, mtime int64, ctime int64, checksum string, sourceId uint) error {
+func InsertPhoto(userId uint, name string, path string, size int64, photoType PhotoType, livePhotoVideoPath string, fileUri string, mtime int64, ctime int64, checksum string, preChecksum string, sourceId uint) error {
 	if mtime == 0 {
 		mtime = time.Now().Unix()
 	}
@@ -54,6 +85,7 @@ func InsertPhoto(name string, path string, size int64, photoType PhotoType, live
 		ctime = time.Now().Unix()
 	}
 	photo := Photo{
+		UserId:             userId,
 		Name:               name,
 		Path:               strings.TrimPrefix(path, string(os.PathSeparator)),
 		Size:               size,
@@ -63,7 +95,9 @@ func InsertPhoto(name string, path string, size int64, photoType PhotoType, live
 		MTime:              mtime,
 		CTime:              ctime,
 		Checksum:           checksum,
+		PreChecksum:        preChecksum,
 		SourceId:           sourceId,
+		TakenAt:            mtime,
 	}
 	fullPath := photo.FullPath()
 	if !helpers.FileExists(fullPath) {
@@ -84,19 +118,19 @@ func GetPhotoById(id uint) (*Photo, error) {
 	return &photo, nil
 }
 
-// 通过路径查询照片
-func GetPhotoByPath(path string) (*Photo, error) {
+// 通过路径查询用户的照片
+func GetPhotoByPath(userId uint, path string) (*Photo, error) {
 	var photo Photo
-	if err := helpers.Db.Where("path = ?", path).First(&photo).Error; err != nil {
+	if err := helpers.Db.Where("user_id = ? AND path = ?", userId, path).First(&photo).Error; err != nil {
 		return nil, err
 	}
 	return &photo, nil
 }
 
-// 通过fileUri查找照片
-func GetPhotoByFileUri(fileUri string) (*Photo, error) {
+// 通过fileUri查找用户的照片
+func GetPhotoByFileUri(userId uint, fileUri string) (*Photo, error) {
 	var photo Photo
-	if err := helpers.Db.Where("file_uri = ?", fileUri).First(&photo).Error; err != nil {
+	if err := helpers.Db.Where("user_id = ? AND file_uri = ?", userId, fileUri).First(&photo).Error; err != nil {
 		return nil, err
 	}
 	return &photo, nil
@@ -109,10 +143,10 @@ func UpdatePhotoFileUri(sourceId uint, fileUri string) error {
 	})
 }
 
-// 判断PreChecksum是否存在
-func CheckPhotoPreChecksum(PreChecksum string) (bool, error) {
+// 判断大小和PreChecksum都相同的照片是否存在，存在只代表可能重复，需要比对checksum确认
+func CheckPhotoPreChecksum(userId uint, PreChecksum string, size int64) (bool, error) {
 	var photo Photo
-	if err := helpers.Db.Where("pre_checksum = ?", PreChecksum).First(&photo).Error; err != nil {
+	if err := helpers.Db.Where("user_id = ? AND pre_checksum = ? AND size = ?", userId, PreChecksum, size).First(&photo).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return false, nil
 		}
@@ -121,10 +155,10 @@ func CheckPhotoPreChecksum(PreChecksum string) (bool, error) {
 	return true, nil
 }
 
-// 判断checksum是否存在
-func CheckPhotoChecksum(Checksum string) (bool, error) {
+// 判断用户的照片库中checksum是否存在，不同用户之间不去重
+func CheckPhotoChecksum(userId uint, Checksum string) (bool, error) {
 	var photo Photo
-	if err := helpers.Db.Where("checksum = ?", Checksum).First(&photo).Error; err != nil {
+	if err := helpers.Db.Where("user_id = ? AND checksum = ?", userId, Checksum).First(&photo).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return false, nil
 		}
@@ -133,9 +167,65 @@ func CheckPhotoChecksum(Checksum string) (bool, error) {
 	return true, nil
 }
 
-// 根据路径删除一张照片
-func DeletePhotoByPath(path string) error {
-	photo, err := GetPhotoByPath(path)
+// 批量查询时每次IN查询的参数个数，避免超过sqlite的参数上限
+const batchQuerySize = 500
+
+// 批量查询已存在的checksum，返回checksum到照片路径的映射，不存在的checksum不在结果中
+func GetPhotoPathsByChecksums(userId uint, checksums []string) (map[string]string, error) {
+	return getPhotoPathsBy(userId, "checksum", checksums)
+}
+
+// 批量查询已存在的fileUri，返回fileUri到照片路径的映射，不存在的fileUri不在结果中
+func GetPhotoPathsByFileUris(userId uint, fileUris []string) (map[string]string, error) {
+	return getPhotoPathsBy(userId, "file_uri", fileUris)
+}
+
+// 批量查询大小和PreChecksum都相同的照片，返回PreChecksum到可能重复的照片checksum列表的映射
+// sizes与preChecksums一一对应
+func GetPhotoChecksumsByPreChecksums(userId uint, preChecksums []string, sizes []int64) (map[string][]string, error) {
+	wanted := make(map[string]int64, len(preChecksums))
+	for i, pre := range preChecksums {
+		wanted[pre] = sizes[i]
+	}
+	result := make(map[string][]string)
+	for start := 0; start < len(preChecksums); start += batchQuerySize {
+		end := min(start+batchQuerySize, len(preChecksums))
+		photos := make([]Photo, 0)
+		if err := helpers.Db.Select("size", "checksum", "pre_checksum").Where("user_id = ? AND pre_checksum IN ?", userId, preChecksums[start:end]).Find(&photos).Error; err != nil {
+			return nil, err
+		}
+		for _, p := range photos {
+			if wanted[p.PreChecksum] == p.Size {
+				result[p.PreChecksum] = append(result[p.PreChecksum], p.Checksum)
+			}
+		}
+	}
+	return result, nil
+}
+
+// 按索引字段分批查询照片路径
+func getPhotoPathsBy(userId uint, column string, values []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for start := 0; start < len(values); start += batchQuerySize {
+		end := min(start+batchQuerySize, len(values))
+		photos := make([]Photo, 0)
+		if err := helpers.Db.Select("path", column).Where("user_id = ? AND "+column+" IN ?", userId, values[start:end]).Find(&photos).Error; err != nil {
+			return nil, err
+		}
+		for _, p := range photos {
+			if column == "checksum" {
+				result[p.Checksum] = p.Path
+			} else {
+				result[p.FileURI] = p.Path
+			}
+		}
+	}
+	return result, nil
+}
+
+// 根据路径删除用户的一张照片
+func DeletePhotoByPath(userId uint, path string) error {
+	photo, err := GetPhotoByPath(userId, path)
 	if err != nil {
 		return err
 	}
@@ -153,19 +243,222 @@ func DeletePhotoByPath(path string) error {
 	return nil
 }
 
-// 查询照片列表
-func ListPhotos(page int, pageSize int) (int64, []*Photo, error) {
+// 照片列表的查询条件，零值表示不限制
+type PhotoFilter struct {
+	Type   PhotoType // 照片类型
+	From   int64     // 拍摄时间的开始，Unix时间戳，单位秒
+	To     int64     // 拍摄时间的结束，Unix时间戳，单位秒
+	Dir    string    // 只查询该目录（包括子目录）下的照片，相对用户照片目录的路径
+	Name   string    // 文件名包含该字符串
+	Camera string    // 相机厂商或型号包含该字符串
+	HasGPS *bool     // 是否有拍摄地点
+}
+
+func (f PhotoFilter) apply(db *gorm.DB) *gorm.DB {
+	if f.Type > 0 {
+		db = db.Where("type = ?", f.Type)
+	}
+	if f.From > 0 {
+		db = db.Where("taken_at >= ?", f.From)
+	}
+	if f.To > 0 {
+		db = db.Where("taken_at <= ?", f.To)
+	}
+	if f.Dir != "" {
+		db = db.Where("path LIKE ? ESCAPE '\\'", escapeLike(f.Dir)+"/%")
+	}
+	if f.Name != "" {
+		db = db.Where("name LIKE ? ESCAPE '\\'", "%"+escapeLike(f.Name)+"%")
+	}
+	if f.Camera != "" {
+		camera := "%" + escapeLike(f.Camera) + "%"
+		db = db.Where("(camera_make LIKE ? ESCAPE '\\' OR camera_model LIKE ? ESCAPE '\\')", camera, camera)
+	}
+	if f.HasGPS != nil {
+		if *f.HasGPS {
+			db = db.Where("latitude IS NOT NULL")
+		} else {
+			db = db.Where("latitude IS NULL")
+		}
+	}
+	return db
+}
+
+// 照片列表可以排序的字段，键为客户端传入的字段名，值为数据库列名
+var PhotoSortColumns = map[string]string{
+	"taken_at":   "taken_at",
+	"mtime":      "m_time",
+	"ctime":      "c_time",
+	"created_at": "created_at",
+	"name":       "name",
+	"size":       "size",
+}
+
+// 照片列表的排序，字段相同时按ID排序，保证分页时顺序稳定
+type PhotoSort struct {
+	Field string // PhotoSortColumns中的键，为空时按拍摄时间排序
+	Asc   bool   // 是否升序，默认降序
+}
+
+func (s PhotoSort) field() string {
+	if _, ok := PhotoSortColumns[s.Field]; ok {
+		return s.Field
+	}
+	return "taken_at"
+}
+
+func (s PhotoSort) order() string {
+	direction := "DESC"
+	if s.Asc {
+		direction = "ASC"
+	}
+	column := PhotoSortColumns[s.field()]
+	return column + " " + direction + ", id " + direction
+}
+
+// 照片排序字段的值
+func (s PhotoSort) value(photo *Photo) any {
+	switch s.field() {
+	case "mtime":
+		return photo.MTime
+	case "ctime":
+		return photo.CTime
+	case "created_at":
+		return photo.CreatedAt
+	case "name":
+		return photo.Name
+	case "size":
+		return photo.Size
+	default:
+		return photo.TakenAt
+	}
+}
+
+// 生成照片所在位置的游标，prev为true时用于查询该照片之前的照片
+func (s PhotoSort) Cursor(photo *Photo, prev bool) PhotoCursor {
+	return PhotoCursor{Sort: s.field(), Asc: s.Asc, Value: s.value(photo), ID: photo.ID, Prev: prev}
+}
+
+// 游标分页的位置，记录一张照片的排序字段值和ID，查询排序在该照片之后（或之前）的照片
+// 新上传的照片不会影响游标的位置，翻页时不会跳过或者重复照片
+type PhotoCursor struct {
+	Sort  string `json:"s"` // 排序字段，PhotoSortColumns中的键
+	Asc   bool   `json:"a"` // 是否升序
+	Value any    `json:"v"` // 照片排序字段的值
+	ID    uint   `json:"i"` // 照片ID
+	Prev  bool   `json:"p"` // 是否查询之前的照片
+}
+
+// 编码为不透明的字符串返回给客户端
+func (c PhotoCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+var ErrInvalidCursor = errors.New("cursor参数错误")
+
+// 解析客户端传入的游标
+func DecodePhotoCursor(s string) (*PhotoCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var cursor PhotoCursor
+	if err := decoder.Decode(&cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if _, ok := PhotoSortColumns[cursor.Sort]; !ok || cursor.ID == 0 {
+		return nil, ErrInvalidCursor
+	}
+	// 排序字段除了name都是整数
+	switch v := cursor.Value.(type) {
+	case string:
+		if cursor.Sort != "name" {
+			return nil, ErrInvalidCursor
+		}
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil || cursor.Sort == "name" {
+			return nil, ErrInvalidCursor
+		}
+		cursor.Value = n
+	default:
+		return nil, ErrInvalidCursor
+	}
+	return &cursor, nil
+}
+
+// 用户照片列表的查询，时间线中不包括转码生成的照片和动态照片中的视频
+func photoListQuery(userId uint, filter PhotoFilter) *gorm.DB {
+	db := helpers.Db.Model(&Photo{}).Where("user_id = ?", userId).Where("source_id=0 AND (type <> ? OR (type=? AND live_photo_video_path != ''))", PhotoTypeLivePhoto, PhotoTypeLivePhoto)
+	return filter.apply(db)
+}
+
+// 查询用户的照片列表
+func ListPhotos(userId uint, filter PhotoFilter, sort PhotoSort, page int, pageSize int) (int64, []*Photo, error) {
 	var photos []*Photo = make([]*Photo, 0)
 	// 先查询总数
 	var total int64
-	if err := helpers.Db.Model(&Photo{}).Where("source_id=0 AND (type <> ? OR (type=? AND live_photo_video_path != ''))", PhotoTypeLivePhoto, PhotoTypeLivePhoto).Count(&total).Error; err != nil {
+	if err := photoListQuery(userId, filter).Count(&total).Error; err != nil {
 		return 0, nil, err
 	}
 
 	// 再分页查询列表
-	if err := helpers.Db.Offset((page-1)*pageSize).Limit(pageSize).Where("source_id=0 AND (type <> ? OR (type=? AND live_photo_video_path != ''))", PhotoTypeLivePhoto, PhotoTypeLivePhoto).Order("m_time DESC").Find(&photos).Error; err != nil {
+	if err := photoListQuery(userId, filter).Offset((page - 1) * pageSize).Limit(pageSize).Order(sort.order()).Find(&photos).Error; err != nil {
 		helpers.AppLogger.Error("查询照片列表失败: ", err)
 		return 0, nil, err
 	}
 	return total, photos, nil
 }
+
+// 使用游标查询用户的照片列表，返回总数、照片和游标方向上是否还有更多照片
+// 向前查询时返回的照片仍然按排序顺序排列
+func ListPhotosByCursor(userId uint, filter PhotoFilter, cursor PhotoCursor, limit int) (int64, []*Photo, bool, error) {
+	var photos []*Photo = make([]*Photo, 0)
+	var total int64
+	if err := photoListQuery(userId, filter).Count(&total).Error; err != nil {
+		return 0, nil, false, err
+	}
+	query, sort := photoCursorQuery(userId, filter, cursor)
+	// 多查询一张用来判断是否还有更多照片
+	if err := query.Limit(limit + 1).Order(sort.order()).Find(&photos).Error; err != nil {
+		helpers.AppLogger.Error("查询照片列表失败: ", err)
+		return 0, nil, false, err
+	}
+	more := len(photos) > limit
+	if more {
+		photos = photos[:limit]
+	}
+	if cursor.Prev {
+		slices.Reverse(photos)
+	}
+	return total, photos, more, nil
+}
+
+// 游标方向上是否还有照片，不包括游标位置的照片
+func HasPhotosByCursor(userId uint, filter PhotoFilter, cursor PhotoCursor) (bool, error) {
+	query, sort := photoCursorQuery(userId, filter, cursor)
+	var ids []uint
+	if err := query.Limit(1).Order(sort.order()).Pluck("id", &ids).Error; err != nil {
+		return false, err
+	}
+	return len(ids) > 0, nil
+}
+
+// 游标之后（向前查询时为之前）的照片的查询条件，返回查询和离游标从近到远的排序
+func photoCursorQuery(userId uint, filter PhotoFilter, cursor PhotoCursor) (*gorm.DB, PhotoSort) {
+	sort := PhotoSort{Field: cursor.Sort, Asc: cursor.Asc}
+	// 向后查询时降序取更小的值，升序取更大的值；向前查询相反，并且按相反的顺序查询离游标最近的照片
+	op := "<"
+	if sort.Asc != cursor.Prev {
+		op = ">"
+	}
+	if cursor.Prev {
+		sort.Asc = !sort.Asc
+	}
+	column := PhotoSortColumns[cursor.Sort]
+	query := photoListQuery(userId, filter).Where("("+column+" "+op+" ? OR ("+column+" = ? AND id "+op+" ?))", cursor.Value, cursor.Value, cursor.ID)
+	return query, sort
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/qicfan/backup-server/helpers"
+)
+
+func TestPhotoCursorEncodeDecode(t *testing.T) {
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	cases := []struct {
+		name   string
+		cursor string
+		want   *PhotoCursor
+	}{
+		{"taken_at", PhotoCursor{Sort: "taken_at", Value: int64(1700000000), ID: 3}.Encode(), &PhotoCursor{Sort: "taken_at", Value: int64(1700000000), ID: 3}},
+		{"name prev", PhotoCursor{Sort: "name", Asc: true, Value: "IMG_0001.jpg", ID: 7, Prev: true}.Encode(), &PhotoCursor{Sort: "name", Asc: true, Value: "IMG_0001.jpg", ID: 7, Prev: true}},
+		{"bad base64", "!!!", nil},
+		{"bad json", encode(`{"s":`), nil},
+		{"unknown sort", encode(`{"s":"path","v":1,"i":1}`), nil},
+		{"zero id", encode(`{"s":"size","v":1,"i":0}`), nil},
+		{"string value", encode(`{"s":"size","v":"1","i":1}`), nil},
+		{"number name", encode(`{"s":"name","v":1,"i":1}`), nil},
+		{"float value", encode(`{"s":"mtime","v":1.5,"i":1}`), nil},
+		{"missing value", encode(`{"s":"mtime","i":1}`), nil},
+	}
+	for _, c := range cases {
+		got, err := DecodePhotoCursor(c.cursor)
+		if c.want == nil {
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("%s: err = %v, want %v", c.name, err, ErrInvalidCursor)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if *got != *c.want {
+			t.Errorf("%s: got %+v, want %+v", c.name, *got, *c.want)
+		}
+	}
+}
+
+func TestListPhotosByCursor(t *testing.T) {
+	const userId = 900
+	// 按拍摄时间降序：id大的照片拍摄时间更晚，两张照片拍摄时间相同时按ID排序
+	for i := 1; i <= 5; i++ {
+		photo := Photo{UserId: userId, Name: fmt.Sprintf("c%d.jpg", i), Path: fmt.Sprintf("c%d.jpg", i), Type: PhotoTypeNormal, Checksum: fmt.Sprintf("cursor%d", i), TakenAt: int64(1000 + i/2)}
+		if err := helpers.Db.Create(&photo).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	sort := PhotoSort{Field: "taken_at"}
+	ids := func(photos []*Photo) string {
+		s := ""
+		for _, p := range photos {
+			s += p.Name + " "
+		}
+		return s
+	}
+	_, first, err := ListPhotos(userId, PhotoFilter{}, sort, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(first); got != "c5.jpg c4.jpg " {
+		t.Fatalf("first page = %s", got)
+	}
+	// 第一页之前没有照片
+	if has, err := HasPhotosByCursor(userId, PhotoFilter{}, sort.Cursor(first[0], true)); err != nil || has {
+		t.Errorf("before first page: has = %v, err = %v", has, err)
+	}
+	_, second, more, err := ListPhotosByCursor(userId, PhotoFilter{}, sort.Cursor(first[1], false), 2)
+	if err != nil || !more || ids(second) != "c3.jpg c2.jpg " {
+		t.Fatalf("second page = %s, more = %v, err = %v", ids(second), more, err)
+	}
+	_, last, more, err := ListPhotosByCursor(userId, PhotoFilter{}, sort.Cursor(second[1], false), 2)
+	if err != nil || more || ids(last) != "c1.jpg " {
+		t.Fatalf("last page = %s, more = %v, err = %v", ids(last), more, err)
+	}
+	// 从最后一页向前查询，照片仍然按排序顺序返回
+	_, prev, more, err := ListPhotosByCursor(userId, PhotoFilter{}, sort.Cursor(last[0], true), 2)
+	if err != nil || !more || ids(prev) != "c3.jpg c2.jpg " {
+		t.Fatalf("prev page = %s, more = %v, err = %v", ids(prev), more, err)
+	}
+	_, prev, more, err = ListPhotosByCursor(userId, PhotoFilter{}, sort.Cursor(prev[0], true), 2)
+	if err != nil || more || ids(prev) != "c5.jpg c4.jpg " {
+		t.Fatalf("first page by prev cursor = %s, more = %v, err = %v", ids(prev), more, err)
+	}
+	if has, err := HasPhotosByCursor(userId, PhotoFilter{}, sort.Cursor(last[0], false)); err != nil || has {
+		t.Errorf("after last page: has = %v, err = %v", has, err)
+	}
+}
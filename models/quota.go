@@ -0,0 +1,100 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/qicfan/backup-server/helpers"
+)
+
+// 超出存储配额
+var ErrQuotaExceeded = errors.New("超出存储配额")
+
+// 配额不能为负数，0表示使用默认配额
+var ErrInvalidQuota = errors.New("存储配额不能小于0")
+
+// 存储空间的使用情况，单位字节，Limit为0表示不限制
+type QuotaUsage struct {
+	Used        int64 `json:"used"`        // 当前账号已使用的空间
+	Limit       int64 `json:"limit"`       // 当前账号的配额
+	GlobalUsed  int64 `json:"globalUsed"`  // 所有照片已使用的空间
+	GlobalLimit int64 `json:"globalLimit"` // 全局配额
+	Available   int64 `json:"available"`   // 剩余可用空间，-1表示不限制
+}
+
+// 所有照片（包括转码后的副本）占用的空间
+func GetStorageUsed() (int64, error) {
+	var used int64
+	if err := helpers.Db.Model(&Photo{}).Select("COALESCE(SUM(size), 0)").Scan(&used).Error; err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// 用户的照片（包括转码后的副本）占用的空间
+func GetUserStorageUsed(userId uint) (int64, error) {
+	var used int64
+	if err := helpers.Db.Model(&Photo{}).Where("user_id = ?", userId).Select("COALESCE(SUM(size), 0)").Scan(&used).Error; err != nil {
+		return 0, err
+	}
+	return used, nil
+}
+
+// 查询用户的存储空间使用情况
+func GetQuotaUsage(userId uint) (*QuotaUsage, error) {
+	user, err := GetUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	globalUsed, err := GetStorageUsed()
+	if err != nil {
+		return nil, err
+	}
+	used, err := GetUserStorageUsed(userId)
+	if err != nil {
+		return nil, err
+	}
+	limit := user.Quota
+	if limit == 0 {
+		limit = helpers.UserQuota
+	}
+	usage := &QuotaUsage{
+		Used:        used,
+		Limit:       limit,
+		GlobalUsed:  globalUsed,
+		GlobalLimit: helpers.GlobalQuota,
+		Available:   -1,
+	}
+	if usage.Limit > 0 {
+		usage.Available = max(usage.Limit-usage.Used, 0)
+	}
+	if usage.GlobalLimit > 0 {
+		globalAvailable := max(usage.GlobalLimit-usage.GlobalUsed, 0)
+		if usage.Available < 0 || globalAvailable < usage.Available {
+			usage.Available = globalAvailable
+		}
+	}
+	return usage, nil
+}
+
+// 检查是否还有空间保存size字节的文件
+// userReserved: 该用户正在上传还未入库的文件占用的空间，只计入该用户的配额
+// globalReserved: 所有用户正在上传还未入库的文件占用的空间，只计入全局配额
+func CheckQuota(userId uint, size int64, userReserved int64, globalReserved int64) error {
+	usage, err := GetQuotaUsage(userId)
+	if err != nil {
+		return err
+	}
+	return usage.Check(size, userReserved, globalReserved)
+}
+
+// 按使用情况检查是否还有空间保存size字节的文件，参数同CheckQuota
+func (u *QuotaUsage) Check(size int64, userReserved int64, globalReserved int64) error {
+	if u.Limit > 0 && u.Used+userReserved+size > u.Limit {
+		return fmt.Errorf("%w: 需要 %d 字节，账号剩余 %d 字节", ErrQuotaExceeded, size, max(u.Limit-u.Used-userReserved, 0))
+	}
+	if u.GlobalLimit > 0 && u.GlobalUsed+globalReserved+size > u.GlobalLimit {
+		return fmt.Errorf("%w: 需要 %d 字节，服务器剩余 %d 字节", ErrQuotaExceeded, size, max(u.GlobalLimit-u.GlobalUsed-globalReserved, 0))
+	}
+	return nil
+}
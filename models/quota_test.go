@@ -0,0 +1,37 @@
+package models
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQuotaUsageCheck(t *testing.T) {
+	cases := []struct {
+		name           string
+		usage          QuotaUsage
+		size           int64
+		userReserved   int64
+		globalReserved int64
+		wantErr        bool
+	}{
+		{"unlimited", QuotaUsage{Used: 1 << 40}, 1 << 30, 1 << 30, 1 << 30, false},
+		{"within user quota", QuotaUsage{Used: 60, Limit: 100}, 40, 0, 0, false},
+		{"exceeds user quota", QuotaUsage{Used: 60, Limit: 100}, 41, 0, 0, true},
+		{"user reserved counts", QuotaUsage{Used: 60, Limit: 100}, 20, 30, 0, true},
+		{"global reserved not in user quota", QuotaUsage{Used: 60, Limit: 100}, 20, 0, 1000, false},
+		{"within global quota", QuotaUsage{GlobalUsed: 900, GlobalLimit: 1000}, 100, 0, 0, false},
+		{"exceeds global quota", QuotaUsage{GlobalUsed: 900, GlobalLimit: 1000}, 101, 0, 0, true},
+		{"global reserved counts", QuotaUsage{GlobalUsed: 900, GlobalLimit: 1000}, 50, 0, 60, true},
+		{"user reserved not in global quota", QuotaUsage{GlobalUsed: 900, GlobalLimit: 1000}, 50, 500, 0, false},
+		{"both quotas", QuotaUsage{Used: 10, Limit: 100, GlobalUsed: 990, GlobalLimit: 1000}, 20, 0, 0, true},
+	}
+	for _, c := range cases {
+		err := c.usage.Check(c.size, c.userReserved, c.globalReserved)
+		if c.wantErr != (err != nil) {
+			t.Errorf("%s: err = %v, wantErr %v", c.name, err, c.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrQuotaExceeded) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, ErrQuotaExceeded)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package models
+
+import "slices"
+
+// 权限范围，账号通过角色获得权限，API Key在创建时指定权限，两者都满足才能访问
+const (
+	ScopeUpload = "upload" // 上传文件、检查文件是否存在、创建目录、更新照片信息
+	ScopeRead   = "read"   // 查看照片列表、目录列表、缩略图和下载
+	ScopeAdmin  = "admin"  // 管理账号，包含其他所有权限
+)
+
+var Scopes = []string{ScopeUpload, ScopeRead, ScopeAdmin}
+
+// 账号的角色
+const (
+	RoleAdmin      = "admin"      // 管理员，拥有所有权限
+	RoleMember     = "member"     // 普通成员，可以上传和浏览自己的照片
+	RoleReadOnly   = "readonly"   // 只读，只能浏览和下载
+	RoleUploadOnly = "uploadonly" // 只能上传，无法浏览和下载，适合无人值守的备份设备
+)
+
+// 每个角色拥有的权限
+var roleScopes = map[string][]string{
+	RoleAdmin:      {ScopeAdmin, ScopeUpload, ScopeRead},
+	RoleMember:     {ScopeUpload, ScopeRead},
+	RoleReadOnly:   {ScopeRead},
+	RoleUploadOnly: {ScopeUpload},
+}
+
+// 是否为支持的角色
+func ValidRole(role string) bool {
+	_, ok := roleScopes[role]
+	return ok
+}
+
+// 是否为管理员
+func (u *User) IsAdmin() bool {
+	return u.Role == RoleAdmin
+}
+
+// 账号的角色是否拥有某个权限
+func (u *User) HasScope(scope string) bool {
+	return slices.Contains(roleScopes[u.Role], scope)
+}
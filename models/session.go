@@ -0,0 +1,101 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+	"gorm.io/gorm"
+)
+
+var ErrSessionRevoked = errors.New("登录已失效，请重新登录")
+
+// 最后活动时间的更新间隔，避免每个请求都写数据库
+const sessionTouchInterval = time.Minute
+
+// 设备会话，每次登录创建一个，访问Token和刷新Token都属于某个会话
+// 会话被撤销（删除）后，该会话的Token立即失效
+type DeviceSession struct {
+	BaseModel
+	UserId   uint             `json:"user_id" gorm:"index"` // 会话所属的用户
+	Name     string           `json:"name"`                 // 设备名称，登录时由客户端提供
+	ClientOS helpers.ClientOS `json:"client_os"`            // 客户端操作系统
+	IP       string           `json:"ip"`                   // 最后一次访问的IP
+	LastSeen int64            `json:"last_seen"`            // 最后一次访问的时间，Unix时间戳，单位秒
+}
+
+// 创建设备会话
+func CreateDeviceSession(userId uint, name string, clientOS helpers.ClientOS, ip string) (*DeviceSession, error) {
+	session := DeviceSession{UserId: userId, Name: name, ClientOS: clientOS, IP: ip, LastSeen: time.Now().Unix()}
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Create(&session).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// 查询用户的设备会话，会话不存在（已被撤销）时返回ErrSessionRevoked
+func GetDeviceSession(userId uint, id uint) (*DeviceSession, error) {
+	var session DeviceSession
+	if err := helpers.Db.Where("id = ? AND user_id = ?", id, userId).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionRevoked
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// 更新会话的最后活动时间和IP，距离上次更新不足sessionTouchInterval并且IP没有变化时跳过
+func (s *DeviceSession) Touch(ip string) {
+	now := time.Now().Unix()
+	if s.IP == ip && now-s.LastSeen < int64(sessionTouchInterval.Seconds()) {
+		return
+	}
+	s.IP = ip
+	s.LastSeen = now
+	id := s.ID
+	helpers.EnqueueDBWrite(func(db *gorm.DB) error {
+		return db.Model(&DeviceSession{}).Where("id = ?", id).Updates(map[string]any{"ip": ip, "last_seen": now}).Error
+	})
+}
+
+// 查询用户的所有设备会话，最近活动的排在前面
+func ListDeviceSessions(userId uint) ([]*DeviceSession, error) {
+	sessions := make([]*DeviceSession, 0)
+	if err := helpers.Db.Where("user_id = ?", userId).Order("last_seen DESC").Find(&sessions).Error; err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// 撤销用户的一个设备会话，同时删除该会话的刷新Token
+func RevokeDeviceSession(userId uint, id uint) error {
+	return helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Where("id = ? AND user_id = ?", id, userId).Delete(&DeviceSession{})
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 0 {
+				return gorm.ErrRecordNotFound
+			}
+			return tx.Where("session_id = ?", id).Delete(&RefreshToken{}).Error
+		})
+	})
+}
+
+// 撤销用户的所有设备会话，exceptId不为0时保留该会话
+// 修改密码、禁用用户后其他设备需要重新登录
+func RevokeUserSessions(userId uint, exceptId uint) error {
+	return helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id = ? AND id <> ?", userId, exceptId).Delete(&DeviceSession{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("user_id = ? AND session_id <> ?", userId, exceptId).Delete(&RefreshToken{}).Error
+		})
+	})
+}
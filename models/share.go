@@ -0,0 +1,166 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+var ErrShareLinkInvalid = errors.New("分享链接不存在、已过期或已被撤销")
+
+// 分享链接，没有账号的人可以通过链接查看和下载一张或者一组照片
+type ShareLink struct {
+	BaseModel
+	UserId       uint   `json:"user_id" gorm:"index"`     // 分享者
+	Token        string `json:"token" gorm:"uniqueIndex"` // 链接中的随机字符串
+	Name         string `json:"name"`                     // 分享的名称
+	PhotoIds     string `json:"photo_ids"`                // 分享的照片ID，逗号分隔
+	PasswordHash string `json:"-"`                        // 访问密码，bcrypt加密，为空表示不需要密码
+	ExpiresAt    int64  `json:"expires_at"`               // 过期时间，Unix时间戳，单位秒，0表示永不过期
+	Revoked      bool   `json:"revoked"`                  // 是否已撤销
+	Views        int64  `json:"views"`                    // 访问次数
+}
+
+// 分享是否需要密码
+func (s *ShareLink) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// 校验访问密码，没有设置密码时总是返回true
+func (s *ShareLink) CheckPassword(password string) bool {
+	if !s.HasPassword() {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+// 分享的照片ID列表
+func (s *ShareLink) PhotoIdList() []uint {
+	ids := make([]uint, 0)
+	for _, v := range strings.Split(s.PhotoIds, ",") {
+		if id, err := strconv.ParseUint(v, 10, 64); err == nil {
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
+
+// 照片是否在分享中
+func (s *ShareLink) Contains(photoId uint) bool {
+	return slices.Contains(s.PhotoIdList(), photoId)
+}
+
+// 分享中的照片，已经被删除的照片会被忽略
+func (s *ShareLink) Photos() ([]*Photo, error) {
+	photos := make([]*Photo, 0)
+	if err := helpers.Db.Where("user_id = ? AND id IN ?", s.UserId, s.PhotoIdList()).Order("taken_at DESC, id DESC").Find(&photos).Error; err != nil {
+		return nil, err
+	}
+	return photos, nil
+}
+
+// 访问次数加一
+func (s *ShareLink) AddView() {
+	s.Views++
+	id := s.ID
+	helpers.EnqueueDBWrite(func(db *gorm.DB) error {
+		return db.Model(&ShareLink{}).Where("id = ?", id).Update("views", gorm.Expr("views + 1")).Error
+	})
+}
+
+// 创建分享链接，照片必须属于该用户
+func CreateShareLink(userId uint, name string, photoIds []uint, password string, expiresAt int64) (*ShareLink, error) {
+	if len(photoIds) == 0 {
+		return nil, fmt.Errorf("至少需要分享一张照片")
+	}
+	slices.Sort(photoIds)
+	photoIds = slices.Compact(photoIds)
+	var count int64
+	if err := helpers.Db.Model(&Photo{}).Where("user_id = ? AND id IN ?", userId, photoIds).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count != int64(len(photoIds)) {
+		return nil, fmt.Errorf("照片不存在")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(photoIds))
+	for _, id := range photoIds {
+		ids = append(ids, strconv.FormatUint(uint64(id), 10))
+	}
+	share := ShareLink{
+		UserId:    userId,
+		Token:     hex.EncodeToString(b),
+		Name:      name,
+		PhotoIds:  strings.Join(ids, ","),
+		ExpiresAt: expiresAt,
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		share.PasswordHash = string(hash)
+	}
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Create(&share).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+// 分享链接在now时是否可以访问：没有撤销并且没有过期
+func (s *ShareLink) Available(now time.Time) bool {
+	return !s.Revoked && (s.ExpiresAt == 0 || s.ExpiresAt >= now.Unix())
+}
+
+// 通过链接中的Token查询有效的分享
+func GetShareLinkByToken(token string) (*ShareLink, error) {
+	var share ShareLink
+	if err := helpers.Db.Where("token = ?", token).First(&share).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrShareLinkInvalid
+		}
+		return nil, err
+	}
+	if !share.Available(time.Now()) {
+		return nil, ErrShareLinkInvalid
+	}
+	return &share, nil
+}
+
+// 查询用户的所有分享链接
+func ListShareLinks(userId uint) ([]*ShareLink, error) {
+	shares := make([]*ShareLink, 0)
+	if err := helpers.Db.Where("user_id = ?", userId).Order("id DESC").Find(&shares).Error; err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+// 撤销用户的分享链接，撤销后立即失效，记录保留
+func RevokeShareLink(userId uint, id uint) error {
+	return helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		result := db.Model(&ShareLink{}).Where("id = ? AND user_id = ?", id, userId).Update("revoked", true)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
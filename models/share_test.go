@@ -0,0 +1,45 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestShareLinkAvailable(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		name      string
+		expiresAt int64
+		revoked   bool
+		want      bool
+	}{
+		{"永不过期", 0, false, true},
+		{"未过期", now.Unix() + 60, false, true},
+		{"刚好到期", now.Unix(), false, true},
+		{"已过期", now.Unix() - 1, false, false},
+		{"已撤销", 0, true, false},
+		{"未过期但已撤销", now.Unix() + 60, true, false},
+	}
+	for _, c := range cases {
+		share := &ShareLink{ExpiresAt: c.expiresAt, Revoked: c.revoked}
+		if got := share.Available(now); got != c.want {
+			t.Errorf("%s: Available = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestShareLinkPassword(t *testing.T) {
+	if share := (&ShareLink{}); share.HasPassword() || !share.CheckPassword("") {
+		t.Error("share without password should not require one")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := &ShareLink{PasswordHash: string(hash)}
+	if !share.HasPassword() || !share.CheckPassword("secret") || share.CheckPassword("wrong") || share.CheckPassword("") {
+		t.Error("password check failed")
+	}
+}
@@ -0,0 +1,96 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+	"gorm.io/gorm"
+)
+
+var ErrRefreshTokenInvalid = errors.New("刷新Token无效或已过期")
+
+// 刷新Token，数据库中只保存哈希值
+// 每次使用后旧的Token被删除并签发新的Token（轮换），同一个Token只能使用一次
+type RefreshToken struct {
+	BaseModel
+	UserId    uint   `json:"user_id" gorm:"index"`    // Token所属的用户
+	SessionId uint   `json:"session_id" gorm:"index"` // Token所属的设备会话，会话被撤销时Token一起删除
+	TokenHash string `json:"-" gorm:"uniqueIndex"`    // Token的SHA256
+	ExpiresAt int64  `json:"expires_at" gorm:"index"` // 过期时间，Unix时间戳，单位秒
+}
+
+// 生成随机的Token明文
+func newRefreshTokenValue() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// 为设备会话签发新的刷新Token，返回Token明文
+func CreateRefreshToken(session *DeviceSession, ttl time.Duration) (string, error) {
+	token, err := newRefreshTokenValue()
+	if err != nil {
+		return "", err
+	}
+	refreshToken := RefreshToken{UserId: session.UserId, SessionId: session.ID, TokenHash: helpers.BytesSHA256([]byte(token)), ExpiresAt: time.Now().Add(ttl).Unix()}
+	err = helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Create(&refreshToken).Error
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// 使用刷新Token换取新的刷新Token，旧的Token立即失效
+// 返回新的刷新Token记录和明文
+func RotateRefreshToken(token string, ttl time.Duration) (*RefreshToken, string, error) {
+	newToken, err := newRefreshTokenValue()
+	if err != nil {
+		return nil, "", err
+	}
+	var refreshToken RefreshToken
+	err = helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			var old RefreshToken
+			if err := tx.Where("token_hash = ?", helpers.BytesSHA256([]byte(token))).First(&old).Error; err != nil {
+				if errors.Is(err, gorm.ErrRecordNotFound) {
+					return ErrRefreshTokenInvalid
+				}
+				return err
+			}
+			if old.ExpiresAt < time.Now().Unix() {
+				return ErrRefreshTokenInvalid
+			}
+			if err := tx.Delete(&old).Error; err != nil {
+				return err
+			}
+			refreshToken = RefreshToken{UserId: old.UserId, SessionId: old.SessionId, TokenHash: helpers.BytesSHA256([]byte(newToken)), ExpiresAt: time.Now().Add(ttl).Unix()}
+			return tx.Create(&refreshToken).Error
+		})
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &refreshToken, newToken, nil
+}
+
+// 清理已过期的刷新Token，以及刷新Token都已过期并且超过一天没有活动的设备会话
+func DeleteExpiredRefreshTokens() {
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("expires_at < ?", time.Now().Unix()).Delete(&RefreshToken{}).Error; err != nil {
+				return err
+			}
+			return tx.Where("last_seen < ? AND id NOT IN (?)", time.Now().Add(-24*time.Hour).Unix(), tx.Model(&RefreshToken{}).Select("session_id")).Delete(&DeviceSession{}).Error
+		})
+	})
+	if err != nil {
+		helpers.AppLogger.Errorf("清理过期的刷新Token失败: %v", err)
+	}
+}
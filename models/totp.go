@@ -0,0 +1,143 @@
+package models
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/qicfan/backup-server/helpers"
+	"gorm.io/gorm"
+)
+
+// 两步验证的发行方名称，显示在验证器APP中
+const TotpIssuer = "backup-server"
+
+// 每次生成的恢复码数量
+const recoveryCodeCount = 10
+
+// 两步验证的恢复码，丢失验证器时用来登录，每个恢复码只能使用一次
+// 数据库中只保存哈希值
+type RecoveryCode struct {
+	BaseModel
+	UserId   uint   `json:"user_id" gorm:"index"`
+	CodeHash string `json:"-" gorm:"index"`
+}
+
+// 恢复码格式为 xxxxx-xxxxx，比较时忽略大小写、横线和空格
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// 开始开通两步验证：生成新的密钥，验证码确认后才会启用
+func (u *User) BeginTOTP() error {
+	secret, err := helpers.GenerateTOTPSecret()
+	if err != nil {
+		return err
+	}
+	u.TotpSecret = secret
+	u.TotpEnabled = false
+	u.TotpLastStep = 0
+	return u.UpdateColumns("totp_secret", "totp_enabled", "totp_last_step")
+}
+
+// 校验TOTP验证码，同一个验证码只能使用一次
+// 使用条件更新记录最后使用的时间步长，同时提交的相同验证码只有一个能成功
+func (u *User) VerifyTOTP(code string) bool {
+	return u.verifyTOTPAt(code, time.Now())
+}
+
+// 按指定的时间校验TOTP验证码
+func (u *User) verifyTOTPAt(code string, now time.Time) bool {
+	if u.TotpSecret == "" {
+		return false
+	}
+	step, ok := helpers.ValidateTOTP(u.TotpSecret, strings.TrimSpace(code), now)
+	if !ok || step <= u.TotpLastStep {
+		return false
+	}
+	var used bool
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		result := db.Model(&User{}).Where("id = ? AND totp_last_step < ?", u.ID, step).Update("totp_last_step", step)
+		used = result.RowsAffected > 0
+		return result.Error
+	})
+	if err != nil {
+		helpers.AppLogger.Errorf("更新用户 %s 的验证码使用记录失败: %v", u.Username, err)
+		return false
+	}
+	if !used {
+		// 该验证码或者更新的验证码已经被其他请求使用
+		return false
+	}
+	u.TotpLastStep = step
+	return true
+}
+
+// 使用一个恢复码，成功后该恢复码被删除
+func (u *User) UseRecoveryCode(code string) bool {
+	hash := helpers.BytesSHA256([]byte(normalizeRecoveryCode(code)))
+	var used bool
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		result := db.Where("user_id = ? AND code_hash = ?", u.ID, hash).Delete(&RecoveryCode{})
+		used = result.RowsAffected > 0
+		return result.Error
+	})
+	return err == nil && used
+}
+
+// 校验两步验证：TOTP验证码或者恢复码
+func (u *User) VerifySecondFactor(code string) bool {
+	return u.VerifyTOTP(code) || u.UseRecoveryCode(code)
+}
+
+// 启用两步验证并生成恢复码
+func (u *User) EnableTOTP() ([]string, error) {
+	u.TotpEnabled = true
+	if err := u.UpdateColumns("totp_enabled"); err != nil {
+		return nil, err
+	}
+	return GenerateRecoveryCodes(u.ID)
+}
+
+// 关闭两步验证，删除密钥和恢复码
+func (u *User) DisableTOTP() error {
+	u.TotpSecret = ""
+	u.TotpEnabled = false
+	u.TotpLastStep = 0
+	if err := u.UpdateColumns("totp_secret", "totp_enabled", "totp_last_step"); err != nil {
+		return err
+	}
+	return helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Where("user_id = ?", u.ID).Delete(&RecoveryCode{}).Error
+	})
+}
+
+// 为用户生成一组新的恢复码，之前的恢复码全部失效，返回恢复码明文
+func GenerateRecoveryCodes(userId uint) ([]string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	records := make([]RecoveryCode, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		records = append(records, RecoveryCode{UserId: userId, CodeHash: helpers.BytesSHA256([]byte(code))})
+	}
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id = ?", userId).Delete(&RecoveryCode{}).Error; err != nil {
+				return err
+			}
+			return tx.Create(&records).Error
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
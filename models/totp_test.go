@@ -0,0 +1,121 @@
+package models
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 按RFC 6238计算secret在step时的验证码
+func testTOTPCode(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func createTOTPUser(t *testing.T, username string) *User {
+	t.Helper()
+	user, err := CreateUser(username, "password", RoleMember, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := user.BeginTOTP(); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// 校验验证码使用的固定时间，位于一个时间步长的中间
+var testTOTPTime = time.Unix(1700000015, 0)
+
+func TestVerifyTOTP(t *testing.T) {
+	user := createTOTPUser(t, "totp-verify")
+	step := testTOTPTime.Unix() / 30
+	cases := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{"格式错误", "12345", false},
+		{"上一个时间步长", testTOTPCode(t, user.TotpSecret, step-1), true},
+		{"重复使用", testTOTPCode(t, user.TotpSecret, step-1), false},
+		{"当前时间步长", testTOTPCode(t, user.TotpSecret, step), true},
+		{"更早的时间步长", testTOTPCode(t, user.TotpSecret, step-1), false},
+		{"超出误差范围", testTOTPCode(t, user.TotpSecret, step+2), false},
+	}
+	for _, c := range cases {
+		if got := user.verifyTOTPAt(c.code, testTOTPTime); got != c.want {
+			t.Errorf("%s: verifyTOTPAt(%q) = %v, want %v", c.name, c.code, got, c.want)
+		}
+	}
+	saved, err := GetUserById(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.TotpLastStep != step {
+		t.Errorf("TotpLastStep = %d, want %d", saved.TotpLastStep, step)
+	}
+}
+
+func TestVerifyTOTPConcurrentReplay(t *testing.T) {
+	user := createTOTPUser(t, "totp-replay")
+	code := testTOTPCode(t, user.TotpSecret, testTOTPTime.Unix()/30)
+	// 每个请求各自从数据库读取用户，同时提交同一个验证码
+	var success atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		loaded, err := GetUserById(user.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if loaded.verifyTOTPAt(code, testTOTPTime) {
+				success.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := success.Load(); got != 1 {
+		t.Errorf("%d requests accepted the same code, want 1", got)
+	}
+}
+
+func TestVerifyTOTPKeepsConcurrentChanges(t *testing.T) {
+	user := createTOTPUser(t, "totp-columns")
+	// 管理员在验证期间禁用了该用户
+	admin, err := GetUserById(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.Disabled = true
+	if err := admin.UpdateColumns("disabled"); err != nil {
+		t.Fatal(err)
+	}
+	if !user.verifyTOTPAt(testTOTPCode(t, user.TotpSecret, testTOTPTime.Unix()/30), testTOTPTime) {
+		t.Fatal("VerifyTOTP failed")
+	}
+	saved, err := GetUserById(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Disabled {
+		t.Error("VerifyTOTP overwrote the disabled flag")
+	}
+}
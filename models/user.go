@@ -0,0 +1,206 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+
+	"github.com/qicfan/backup-server/helpers"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// 用户名只允许字母、数字、下划线、点和横线，不能以点开头，用户名同时也是用户照片目录的名称
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,31}$`)
+
+// 用户ID到照片目录名称的缓存，用户名不可修改，所以可以一直缓存
+var userDirCache sync.Map
+
+type User struct {
+	BaseModel
+	Username     string `json:"username" gorm:"unique"` // 用户名
+	PasswordHash string `json:"-"`                      // bcrypt加密后的密码
+	Role         string `json:"role"`                   // 角色：admin/member/readonly/uploadonly，见role.go
+	Disabled     bool   `json:"disabled"`               // 是否禁用，禁用后无法登录，已签发的Token也会失效
+	Quota        int64  `json:"quota"`                  // 存储配额，单位字节，0表示使用默认配额helpers.UserQuota
+	TotpSecret   string `json:"-"`                      // TOTP密钥，base32编码，开通两步验证时生成
+	TotpEnabled  bool   `json:"totp_enabled"`           // 是否已启用两步验证，启用后登录需要验证码或恢复码
+	TotpLastStep int64  `json:"-"`                      // 最后一次使用的验证码的时间步长，防止同一个验证码被重复使用
+}
+
+// 用户的照片目录，相对helpers.UPLOAD_ROOT_DIR的路径
+func (u *User) LibraryDir() string {
+	return u.Username
+}
+
+// 用户照片目录的绝对路径，用户的所有路径参数都相对该目录
+func (u *User) RootDir() string {
+	return filepath.Join(helpers.UPLOAD_ROOT_DIR, u.LibraryDir())
+}
+
+// 将用户目录下的相对路径转换为相对helpers.UPLOAD_ROOT_DIR的路径
+func (u *User) LibraryPath(path string) string {
+	return filepath.Join(u.LibraryDir(), path)
+}
+
+// 解析客户端提供的相对用户照片目录的路径，返回清理后的相对路径和绝对路径
+// 路径位于用户照片目录之外时返回helpers.ErrUnsafePath
+func (u *User) ResolvePath(path string) (string, string, error) {
+	return helpers.ResolvePath(u.RootDir(), path)
+}
+
+// 校验密码是否正确
+func (u *User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil
+}
+
+// 设置密码，只保存bcrypt加密后的值
+func (u *User) SetPassword(password string) error {
+	if password == "" {
+		return errors.New("密码不能为空")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = string(hash)
+	return nil
+}
+
+// 更新用户信息
+func (u *User) Update() error {
+	return helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Save(u).Error
+	})
+}
+
+// 只更新用户的指定字段（数据库列名），不会覆盖其他请求同时修改的字段
+func (u *User) UpdateColumns(columns ...string) error {
+	return helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Model(u).Select(columns).Updates(u).Error
+	})
+}
+
+// 创建一个用户
+func CreateUser(username string, password string, role string, quota int64) (*User, error) {
+	if !usernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("用户名只能包含字母、数字、下划线、点和横线，长度不超过32")
+	}
+	if !ValidRole(role) {
+		return nil, fmt.Errorf("不支持的角色: %s", role)
+	}
+	if quota < 0 {
+		return nil, ErrInvalidQuota
+	}
+	// 用户名同时是照片目录的名称，在不区分大小写的文件系统上Admin和admin是同一个目录，所以用户名不区分大小写唯一
+	var count int64
+	if err := helpers.Db.Model(&User{}).Where("username = ? COLLATE NOCASE", username).Count(&count).Error; err != nil {
+		return nil, err
+	}
+	if count > 0 {
+		return nil, fmt.Errorf("用户 %s 已存在", username)
+	}
+	user := User{Username: username, Role: role, Quota: quota}
+	if err := user.SetPassword(password); err != nil {
+		return nil, err
+	}
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Create(&user).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(user.RootDir(), 0755); err != nil {
+		helpers.AppLogger.Errorf("创建用户 %s 的照片目录失败: %v", username, err)
+	}
+	return &user, nil
+}
+
+// 用户的照片目录名称，相对helpers.UPLOAD_ROOT_DIR，用户不存在时返回空字符串
+func UserDir(userId uint) string {
+	if dir, ok := userDirCache.Load(userId); ok {
+		return dir.(string)
+	}
+	user, err := GetUserById(userId)
+	if err != nil {
+		helpers.AppLogger.Errorf("查询用户 %d 失败: %v", userId, err)
+		return ""
+	}
+	userDirCache.Store(userId, user.LibraryDir())
+	return user.LibraryDir()
+}
+
+// 用户照片目录的绝对路径
+func UserRootDir(userId uint) string {
+	return filepath.Join(helpers.UPLOAD_ROOT_DIR, UserDir(userId))
+}
+
+// 通过ID查询用户
+func GetUserById(id uint) (*User, error) {
+	var user User
+	if err := helpers.Db.Where("id = ?", id).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// 通过用户名查询用户
+func GetUserByUsername(username string) (*User, error) {
+	var user User
+	if err := helpers.Db.Where("username = ?", username).First(&user).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// 查询所有用户
+func ListUsers() ([]*User, error) {
+	users := make([]*User, 0)
+	if err := helpers.Db.Order("id ASC").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// 统计可用的管理员数量，用来避免禁用或删除最后一个管理员
+func CountActiveAdmins() (int64, error) {
+	var count int64
+	if err := helpers.Db.Model(&User{}).Where("role = ? AND disabled = ?", RoleAdmin, false).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// 删除用户和用户的照片记录、设备会话、刷新Token、恢复码、API Key、分享链接，照片文件保留在磁盘上
+func DeleteUser(id uint) error {
+	err := helpers.EnqueueDBWriteSync(func(db *gorm.DB) error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Where("user_id = ?", id).Delete(&Photo{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", id).Delete(&RefreshToken{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", id).Delete(&DeviceSession{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", id).Delete(&RecoveryCode{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", id).Delete(&ApiKey{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("user_id = ?", id).Delete(&ShareLink{}).Error; err != nil {
+				return err
+			}
+			return tx.Delete(&User{}, id).Error
+		})
+	})
+	if err == nil {
+		userDirCache.Delete(id)
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qicfan/backup-server/helpers"
+)
+
+func TestCreateUserRejectsNegativeQuota(t *testing.T) {
+	if _, err := CreateUser("negative_quota", "password", RoleMember, -1); !errors.Is(err, ErrInvalidQuota) {
+		t.Fatalf("err = %v, want %v", err, ErrInvalidQuota)
+	}
+	if _, err := GetUserByUsername("negative_quota"); err == nil {
+		t.Error("user with negative quota was created")
+	}
+}
+
+func TestCreateUserCaseInsensitiveUnique(t *testing.T) {
+	if _, err := CreateUser("CaseUser", "password", RoleMember, 0); err != nil {
+		t.Fatalf("create CaseUser: %v", err)
+	}
+	for _, username := range []string{"CaseUser", "caseuser", "CASEUSER"} {
+		if _, err := CreateUser(username, "password", RoleMember, 0); err == nil {
+			t.Errorf("create %s: want error, got nil", username)
+		}
+	}
+	// 绕过CreateUser的检查时由唯一索引拒绝
+	err := helpers.Db.Create(&User{Username: "caseUSER", Role: RoleMember}).Error
+	if err == nil {
+		t.Error("insert caseUSER: want unique index error, got nil")
+	}
+}